@@ -1,176 +1,402 @@
 package main
 
 import (
-	"encoding/binary"
-	"fmt"
-	"io"
 	"net"
+	"slices"
 	"time"
+
+	"main/common"
 )
 
-func (b *Board) StartClient() error {
+const reconnectAttempts = 5
+const reconnectDelay = time.Second
+
+// how long closing the window waits for the LeftEvent to be sent
+const leaveTimeout = time.Second
+
+// events are batched for this long before being sent, the stroke chunks
+// of a tick are merged into one
+const sendInterval = time.Second / 30
+
+// server frames carry whole boards when joining, so they get a much
+// larger bound than the server gives clients
+const maxFrameSize = 256 << 20
+
+func (b *Board) StartClient(address string) error {
+	b.Client.Address = address
+	return b.Connect()
+}
+
+// Join starts the client and goes back to the join screen if it can't connect
+func (b *Board) Join(address string) {
+	if err := b.StartClient(address); err != nil {
+		b.Client.Logger.Println("Failed to join", err)
+		b.Error = err.Error()
+		b.UiMode = true
+	}
+}
+
+// Leave tells the server we left, giving up after leaveTimeout
+func (b *Board) Leave() {
 	b.Wg.Add(1)
+	if !b.Client.EnqueueEvent(b.Me.Id, "left", common.LeftEvent{}) {
+		return
+	}
 
-	url := fmt.Sprintf("localhost:%d", port)
-	conn, err := net.Dial("tcp", url)
+	left := make(chan struct{})
+	go func() {
+		b.Wg.Wait()
+		close(left)
+	}()
+	select {
+	case <-left:
+	case <-time.After(leaveTimeout):
+	}
+}
+
+// Connect dials the server and sends the handshake,
+// asking to resume the previous session if there was one
+func (b *Board) Connect() error {
+	conn, err := common.Dial(b.Client.Address, b.Client.TLS)
 	if err != nil {
 		return err
 	}
 
-	encondedEvent, _ := Encode(Event{
-		PlayerId:   b.Me.Id,
-		Kind:       "ping",
-		InnerEvent: PingEvent{},
+	err = common.WriteFrame(conn, common.Event{
+		PlayerId: b.Me.Id,
+		Kind:     "ping",
+		InnerEvent: common.PingEvent{
+			Version:      common.ProtocolVersion,
+			Name:         b.Name,
+			Capabilities: common.SupportedCapabilities,
+			ResumeToken:  b.Client.ResumeToken,
+			LastSeq:      b.Client.LastSeq,
+			Password:     b.Password,
+			Room:         b.Room,
+			Spectator:    b.Spectator,
+		},
 	})
+	if err != nil {
+		b.Client.Logger.Println("Failed to send the handshake", err)
+		conn.Close()
+		return err
+	}
+
+	// closed when the read loop stops so the send loop stops too
+	done := make(chan struct{})
+	b.Client.Done = done
+	go b.Client.ClientRead(b, conn, done)
+	go b.Client.CSendEvent(b, conn, done)
+
+	return nil
+}
 
-	length := int32(len(encondedEvent.Bytes()))
-	if err := binary.Write(conn, binary.BigEndian, length); err != nil {
-		b.Client.Logger.Println("Failed to read prefix length")
-		panic(err)
+// Reconnect retries Connect with a growing delay
+func (b *Board) Reconnect() error {
+	var err error
+	for attempt := 1; attempt <= reconnectAttempts; attempt++ {
+		time.Sleep(time.Duration(attempt) * reconnectDelay)
+		if err = b.Connect(); err == nil {
+			return nil
+		}
+		b.Client.Logger.Println("Reconnect attempt", attempt, "failed:", err)
 	}
+	return err
+}
 
-	conn.Write(encondedEvent.Bytes())
+// ManualReconnect is a single attempt, from the disconnected banner
+func (b *Board) ManualReconnect() {
+	b.Reconnecting = true
+	defer func() { b.Reconnecting = false }()
 
-	go b.Client.ClientRead(b, conn)
-	go b.Client.CSendEvent(b, conn)
+	if err := b.Connect(); err != nil {
+		b.DisconnectReason = err.Error()
+	}
+}
 
-	return nil
+// ConnectionLost tries to resume the session when the server gave us a token,
+// otherwise, or if that fails, the board is left disconnected
+func (bc *BoardClient) ConnectionLost(board *Board, err error) {
+	board.Me.Drawing = false
+	board.Painting = false
+	board.Disconnected = true
+	board.DisconnectReason = err.Error()
+	if bc.ResumeToken == "" {
+		return
+	}
+
+	board.Reconnecting = true
+	defer func() { board.Reconnecting = false }()
+	if err := board.Reconnect(); err != nil {
+		board.DisconnectReason = err.Error()
+	}
 }
 
-func (bc *BoardClient) ClientRead(board *Board, conn net.Conn) {
+func (bc *BoardClient) ClientRead(board *Board, conn net.Conn, done chan struct{}) {
+	// runs last, once the send loop of this connection is stopped
+	var lost error
+	defer func() {
+		if lost != nil {
+			bc.ConnectionLost(board, lost)
+		}
+	}()
+	defer close(done)
 	defer conn.Close()
 
 	for {
-		var length int32
-		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
-			serverLogger.Println("Failed to read length:", err)
-			panic(err)
+		// the server sends heartbeats, silence means it's gone
+		if bc.HeartbeatTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(bc.HeartbeatTimeout))
 		}
 
-		buf := make([]byte, length)
-		if _, err := io.ReadFull(conn, buf); err != nil {
-			serverLogger.Println("Failed to read full message:", err)
-			panic(err)
+		buf, err := common.ReadFrame(conn, maxFrameSize)
+		if err != nil {
+			bc.Logger.Println("Failed to read frame:", err)
+			lost = err
+			return
 		}
 
-		event, err := Decode(buf)
+		event, err := common.Decode(buf)
 		if err != nil {
 			bc.Logger.Println("Failed decoding event", err)
-			panic(err)
+			lost = err
+			return
 		}
 
 		if event != nil {
 			bc.CHandleReceivedEvents(board, event, conn)
+			if event.Seq > 0 {
+				bc.LastSeq = event.Seq
+			}
+		}
+
+		// the server closes the connection after an error
+		if _, ok := event.InnerEvent.(common.ErrorEvent); ok {
+			return
 		}
 	}
 }
 
-func (bc *BoardClient) CHandleReceivedEvents(board *Board, event *Event, conn net.Conn) {
+func (bc *BoardClient) CHandleReceivedEvents(board *Board, event *common.Event, conn net.Conn) {
 	switch innerEvent := event.InnerEvent.(type) {
-	case PongEvent:
+	case common.PongEvent:
 		board.Client.Logger.Println("Sending: Player ID received", event.PlayerId)
 		board.Me.Id = event.PlayerId
-		bc.EnqueueEvent(board.Me.Id, "joined", JoinedEvent{})
-	case JoinedEvent:
-		board.Client.Logger.Println("Sending: Player joined", innerEvent.Id)
-		// avoid recreating the Me Player object
-		if innerEvent.Id == board.Me.Id {
-			bc.AddPlayer(board.Me)
-			break
+		bc.Capabilities = innerEvent.Capabilities
+		bc.ResumeToken = innerEvent.ResumeToken
+		bc.HeartbeatTimeout = time.Duration(innerEvent.HeartbeatInterval) * time.Millisecond * time.Duration(innerEvent.HeartbeatMisses)
+		board.Disconnected = false
+		if innerEvent.Resumed {
+			board.Client.Logger.Println("Session resumed from", bc.LastSeq)
 		}
-		bc.AddPlayer(NewPlayer(innerEvent.Id))
-		bc.Players[innerEvent.Id].Drawing = innerEvent.Drawing
-		// bc.Players[innerEvent.Id].Scribbles = innerEvent.Scribbles
-		bc.Players[innerEvent.Id].JustJoined = true
-
-		for _, scribble := range innerEvent.Scribbles {
-			s := NewScribble(scribble)
-			Append(&bc.Players[innerEvent.Id].Scribbles, s)
-			cache := bc.NewCache()
-			Append(&bc.CacheArray, cache)
-			bc.Players[innerEvent.Id].CachedScribbles = append(bc.Players[innerEvent.Id].CachedScribbles, cache)
+	case common.HeartbeatEvent:
+		bc.RoundTrip = time.Duration(innerEvent.RoundTrip)
+		bc.EnqueueEvent(board.Me.Id, "heartbeat", innerEvent)
+	case common.ErrorEvent:
+		board.Client.Logger.Println("Rejected by server:", innerEvent.Message)
+		board.Error = innerEvent.Message
+		board.UiMode = true
+	case common.SnapshotEvent:
+		board.Client.Logger.Println("Sending: Snapshot with", len(innerEvent.Players), "players")
+		// the session was lost, the board is rebuilt from scratch
+		if len(bc.Players) > 0 {
+			bc.Reset(board)
+		}
+		board.Locked = innerEvent.Locked
+		for _, state := range innerEvent.Players {
+			// avoid recreating the Me Player object
+			player := board.Me
+			if state.Id != board.Me.Id {
+				player = NewPlayer(state.Id)
+			}
+			player.Name = state.Name
+			player.Role = state.Role
+			player.Online = state.Online
+			player.Drawing = state.Drawing
+			player.JustJoined = true
+			bc.AddPlayer(player)
+			bc.LoadScribbles(player, state.Scribbles)
 		}
-
 		board.Changed = true
-	case LeftEvent:
+	case common.PlayerJoinedEvent:
+		board.Client.Logger.Println("Sending: Player joined", innerEvent.Id, innerEvent.Name)
+		// players are indexed by id, so a new one is always the next
+		if int(innerEvent.Id) < len(bc.Players) {
+			player := bc.Players[innerEvent.Id]
+			player.Online = true
+			player.Role = innerEvent.Role
+			break
+		}
+		if int(innerEvent.Id) > len(bc.Players) {
+			board.Client.Logger.Println("Player", innerEvent.Id, "joined before the ones in between")
+			break
+		}
+		player := NewPlayer(innerEvent.Id)
+		player.Name = innerEvent.Name
+		player.Role = innerEvent.Role
+		bc.AddPlayer(player)
+	case common.LeftEvent:
 		board.Client.Logger.Println("Sending: Player left", event.PlayerId)
-		// delete(players, event.PlayerId)
-	case StartedEvent:
+		// a resumed session gets its own left replayed, we're back already
+		if event.PlayerId == board.Me.Id {
+			break
+		}
+		// keep the player so its drawings stay on the board
+		for _, player := range bc.Players {
+			if player.Id == event.PlayerId {
+				player.Online = false
+				player.Drawing = false
+			}
+		}
+	case common.StartedEvent:
 		board.Client.Logger.Println("Sending: Player started drawing", event.PlayerId)
-		bc.Players[event.PlayerId].Drawing = true
-		newScribble := NewScribble([]*Pixel{})
+		player := bc.Player(event.PlayerId)
+		if player == nil {
+			break
+		}
+		player.Drawing = true
+		newScribble := NewScribble([]*common.Pixel{})
 		newScribble.BoundingBox = NewBoundingBox()
 		newScribble.BoundingBox.Color = board.CONFIG_COLOR
-		Append(&bc.Players[event.PlayerId].Scribbles, newScribble)
+		common.Append(&player.Scribbles, newScribble)
 
 		cache := bc.NewCache()
-		Append(&bc.CacheArray, cache)
-		Append(&bc.Players[event.PlayerId].CachedScribbles, cache)
-	case DoneEvent:
+		common.Append(&bc.CacheArray, cache)
+		common.Append(&player.CachedScribbles, cache)
+	case common.DoneEvent:
 		board.Client.Logger.Println("Sending: Player done drawing", event.PlayerId)
-		bc.Players[event.PlayerId].Drawing = false
-		bc.Players[event.PlayerId].CachedScribbles[len(bc.Players[event.PlayerId].CachedScribbles)-1].Drawing = false
+		player := bc.Player(event.PlayerId)
+		if player == nil {
+			break
+		}
+		player.Drawing = false
+		// the scribble may be gone already, undone or cleared
+		if len(player.CachedScribbles) > 0 {
+			common.Last(player.CachedScribbles).Drawing = false
+		}
 		board.Changed = false
-	case DrawingEvent:
+	case common.StrokeChunkEvent:
 		board.Client.Logger.Println("Sending: Player sending pixels", event.PlayerId)
-		maxIndex := len(bc.Players[event.PlayerId].Scribbles) - 1
+		player := bc.Player(event.PlayerId)
+		if player == nil {
+			break
+		}
+		maxIndex := len(player.Scribbles) - 1
 		if maxIndex >= 0 {
-			scribble := &bc.Players[event.PlayerId].Scribbles[maxIndex]
-			var min, max = GetMinAndMax(scribble.BoundingBox.Min, scribble.BoundingBox.Max, innerEvent.Pixel)
-			scribble.BoundingBox.Min = min
-			scribble.BoundingBox.Max = max
+			scribble := &player.Scribbles[maxIndex]
+			for _, pixel := range innerEvent.Pixels {
+				var min, max = GetMinAndMax(scribble.BoundingBox.Min, scribble.BoundingBox.Max, pixel)
+				scribble.BoundingBox.Min = min
+				scribble.BoundingBox.Max = max
+			}
 			pixels := &scribble.Pixels
-			Append(pixels, innerEvent.Pixel)
+			*pixels = append(*pixels, innerEvent.Pixels...)
 		}
 		board.Changed = true
-	case UndoEvent:
-		maxIndex := len(bc.Players[event.PlayerId].Scribbles) - 1
+	case common.UndoEvent:
+		player := bc.Player(event.PlayerId)
+		if player == nil {
+			break
+		}
+		maxIndex := len(player.Scribbles) - 1
 		if maxIndex >= 0 {
-			bc.Players[event.PlayerId].Scribbles = bc.Players[event.PlayerId].Scribbles[:maxIndex]
+			player.Scribbles = player.Scribbles[:maxIndex]
 		}
 
-		maxIndex = len(bc.Players[event.PlayerId].CachedScribbles) - 1
+		maxIndex = len(player.CachedScribbles) - 1
 		if maxIndex >= 0 {
-			bc.Players[event.PlayerId].CachedScribbles = bc.Players[event.PlayerId].CachedScribbles[:maxIndex]
-			bc.CacheArray = bc.CacheArray[:len(bc.CacheArray)-1]
+			cache := player.CachedScribbles[maxIndex]
+			player.CachedScribbles = player.CachedScribbles[:maxIndex]
+			// the last cache drawn may be another player's
+			bc.CacheArray = slices.DeleteFunc(bc.CacheArray, func(other *Cache) bool { return other == cache })
 		}
 
 		board.SelectedBoundingBox = nil
 		board.Changed = true
-	case RedoEvent:
-		Append(&bc.Players[event.PlayerId].Scribbles, NewScribble(innerEvent.Pixels))
+	case common.RedoEvent:
+		player := bc.Player(event.PlayerId)
+		if player == nil {
+			break
+		}
+		common.Append(&player.Scribbles, NewScribble(innerEvent.Pixels))
 
 		cache := bc.NewCache()
-		Append(&bc.CacheArray, cache)
-		Append(&bc.Players[event.PlayerId].CachedScribbles, cache)
+		common.Append(&bc.CacheArray, cache)
+		common.Append(&player.CachedScribbles, cache)
 
 		board.Changed = true
-		bc.Players[event.PlayerId].Drawing = true
+		player.Drawing = true
+	case common.RoleEvent:
+		board.Client.Logger.Println("Sending: Player", innerEvent.Id, "is now", innerEvent.Role)
+		if innerEvent.Id >= 0 && int(innerEvent.Id) < len(bc.Players) {
+			bc.Players[innerEvent.Id].Role = innerEvent.Role
+		}
+	case common.LockEvent:
+		board.Client.Logger.Println("Sending: Board locked", innerEvent.Locked)
+		board.Locked = innerEvent.Locked
+	case common.ClearEvent:
+		board.Client.Logger.Println("Sending: Board cleared by", event.PlayerId)
+		// the server ended every stroke first, nobody is drawing
+		for _, player := range bc.Players {
+			player.Scribbles = make([]Scribble, 0)
+			player.CachedScribbles = make([]*Cache, 0)
+		}
+		bc.CacheArray = []*Cache{}
+		board.SelectedBoundingBox = nil
+		board.Changed = true
+	case common.PurgeEvent:
+		board.Client.Logger.Println("Sending: Drawings of player", event.PlayerId, "erased")
+		if event.PlayerId < 0 || int(event.PlayerId) >= len(bc.Players) {
+			break
+		}
+		player := bc.Players[event.PlayerId]
+		bc.CacheArray = slices.DeleteFunc(bc.CacheArray, func(cache *Cache) bool {
+			return slices.Contains(player.CachedScribbles, cache)
+		})
+		player.Scribbles = make([]Scribble, 0)
+		player.CachedScribbles = make([]*Cache, 0)
+		board.SelectedBoundingBox = nil
+		board.Changed = true
 	default:
 		board.Client.Logger.Println("Unknown event type")
 	}
 }
 
-func (bc *BoardClient) CSendEvent(board *Board, conn net.Conn) {
-	ticker := time.NewTicker(2 * time.Millisecond)
+func (bc *BoardClient) LoadScribbles(player *Player, scribbles [][]*common.Pixel) {
+	for _, scribble := range scribbles {
+		s := NewScribble(scribble)
+		common.Append(&player.Scribbles, s)
+		cache := bc.NewCache()
+		common.Append(&bc.CacheArray, cache)
+		player.CachedScribbles = append(player.CachedScribbles, cache)
+	}
+}
+
+func (bc *BoardClient) CSendEvent(board *Board, conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(sendInterval)
 	defer ticker.Stop()
 
-	var batchedEvents []*Event
+	var batchedEvents []*common.Event
 	for {
 		select {
+		case <-done:
+			return
 		case event := <-bc.EventsToSend:
-			Append(&batchedEvents, event)
+			if len(batchedEvents) > 0 && common.MergeChunk(common.Last(batchedEvents), event) {
+				continue
+			}
+			common.Append(&batchedEvents, event)
 
 			if len(batchedEvents) > 50 {
-				for _, event := range batchedEvents {
-					bc.HandleEvent(board, event, conn)
+				if !bc.SendBatch(board, batchedEvents, conn) {
+					return
 				}
 				batchedEvents = batchedEvents[:0]
 			}
 		case <-ticker.C:
 			if len(batchedEvents) > 0 {
-				for _, event := range batchedEvents {
-					bc.HandleEvent(board, event, conn)
+				if !bc.SendBatch(board, batchedEvents, conn) {
+					return
 				}
 				batchedEvents = batchedEvents[:0]
 			}
@@ -178,41 +404,60 @@ func (bc *BoardClient) CSendEvent(board *Board, conn net.Conn) {
 	}
 }
 
-func (bc *BoardClient) HandleEvent(board *Board, event *Event, conn net.Conn) {
-	encondedEvent, err := Encode(*event)
-	if err != nil {
-		bc.Logger.Println("Failed to encode event")
-		panic(err)
-	}
-	length := int32(len(encondedEvent.Bytes()))
-	if err := binary.Write(conn, binary.BigEndian, length); err != nil {
-		bc.Logger.Println("Failed to write prefix length")
-		panic(err)
+// SendBatch returns false when the connection broke, closing it
+// so the read loop notices and takes care of reconnecting
+func (bc *BoardClient) SendBatch(board *Board, events []*common.Event, conn net.Conn) bool {
+	for _, event := range events {
+		if err := bc.HandleEvent(board, event, conn); err != nil {
+			bc.Logger.Println("Failed to send event", err)
+			conn.Close()
+			return false
+		}
 	}
+	return true
+}
+
+func (bc *BoardClient) HandleEvent(board *Board, event *common.Event, conn net.Conn) error {
 	switch event.InnerEvent.(type) {
-	case JoinedEvent:
-		bc.Logger.Println("Receiving: Player joined", event.PlayerId)
-		conn.Write(encondedEvent.Bytes())
-	case LeftEvent:
+	case common.LeftEvent:
 		bc.Logger.Println("Receiving: Player left", event.PlayerId)
-		conn.Write(encondedEvent.Bytes())
-		board.Wg.Done()
-	case StartedEvent:
+		defer board.Wg.Done()
+	case common.StartedEvent:
 		bc.Logger.Println("Receiving: Player started drawing", event.PlayerId)
-		conn.Write(encondedEvent.Bytes())
-	case DoneEvent:
+	case common.DoneEvent:
 		bc.Logger.Println("Receiving: Player done drawing", event.PlayerId)
-		conn.Write(encondedEvent.Bytes())
-	case DrawingEvent:
+	case common.StrokeChunkEvent:
 		bc.Logger.Println("Receiving: Player sending pixels", event.PlayerId)
-		conn.Write(encondedEvent.Bytes())
-	case RedoEvent:
+	case common.RedoEvent:
 		bc.Logger.Println("Receiving: Player sending redo", event.PlayerId)
-		conn.Write(encondedEvent.Bytes())
-	case UndoEvent:
+	case common.UndoEvent:
 		bc.Logger.Println("Receiving: Player sending undo", event.PlayerId)
-		conn.Write(encondedEvent.Bytes())
+	case common.RoleEvent:
+		bc.Logger.Println("Receiving: Owner sending role", event.PlayerId)
+	case common.LockEvent:
+		bc.Logger.Println("Receiving: Owner sending lock", event.PlayerId)
+	case common.ClearEvent:
+		bc.Logger.Println("Receiving: Owner sending clear", event.PlayerId)
+	case common.KickEvent:
+		bc.Logger.Println("Receiving: Owner sending kick", event.PlayerId)
+	case common.HeartbeatEvent:
 	default:
 		bc.Logger.Println("Receiving: Unknown event type")
+		return nil
+	}
+
+	return common.WriteFrame(conn, *event)
+}
+
+// DialAddress turns a listen address into one the host's own client can dial,
+// an empty or unspecified host (":3120", "0.0.0.0:3120") becomes localhost.
+func DialAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
 	}
+	return net.JoinHostPort(host, port)
 }
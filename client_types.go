@@ -1,39 +1,62 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"os"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"main/common"
 
 	rl "github.com/gen2brain/raylib-go/raylib"
 )
 
 type BoardClient struct {
-	Players         []*Player
-	Me              *Player
-	Logger          *Logger
-	EventsToSend    chan *Event
-	CacheArray      []*Cache // This exists because golang maps are unordered
-	CacheLayerIndex int32
+	Players          []*Player
+	Me               *Player
+	Logger           *common.Logger
+	EventsToSend     chan *common.Event
+	Capabilities     common.Capabilities // negotiated with the server on PongEvent
+	Address          string
+	TLS              *tls.Config   // nil connects in plaintext
+	ResumeToken      string        // given on PongEvent, lets us take our player back after a drop
+	LastSeq          uint64        // last broadcast received, the server replays what comes after
+	Done             chan struct{} // closed once the current connection is gone
+	HeartbeatTimeout time.Duration // from PongEvent, 0 means no read deadline
+	RoundTrip        time.Duration // as measured by the server
+	CacheArray       []*Cache      // This exists because golang maps are unordered
+	CacheLayerIndex  int32
 }
 
 func NewBoardClient() *BoardClient {
+	// not connected yet, nothing can be sent
+	done := make(chan struct{})
+	close(done)
+
 	return &BoardClient{
 		Players:         make([]*Player, 0),
 		Me:              NewPlayer(0),
-		Logger:          NewLogger(os.Stdout, "[CLIENT]: ", log.LstdFlags),
-		EventsToSend:    make(chan *Event),
+		Logger:          common.NewLogger(os.Stdout, "[CLIENT]: ", log.LstdFlags),
+		EventsToSend:    make(chan *common.Event),
+		Done:            done,
 		CacheArray:      []*Cache{},
 		CacheLayerIndex: 0,
 	}
 }
 
-func (bc *BoardClient) EnqueueEvent(playerId int32, kind string, innerEvent any) {
-	bc.EventsToSend <- &Event{
+// EnqueueEvent returns false when the event was dropped because we're not connected
+func (bc *BoardClient) EnqueueEvent(playerId int32, kind string, innerEvent any) bool {
+	select {
+	case bc.EventsToSend <- &common.Event{
 		PlayerId:   playerId,
 		Kind:       kind,
 		InnerEvent: innerEvent,
+	}:
+		return true
+	case <-bc.Done:
+		return false
 	}
 }
 
@@ -41,6 +64,30 @@ func (bc *BoardClient) AddPlayer(player *Player) {
 	bc.Players = append(bc.Players, player)
 }
 
+// Player returns the player with that id, nil if we don't know it,
+// the ids are the indexes of Players
+func (bc *BoardClient) Player(id int32) *Player {
+	if id < 0 || int(id) >= len(bc.Players) {
+		return nil
+	}
+	return bc.Players[id]
+}
+
+// Reset forgets every player and drawing, including ours,
+// before the board is sent again by the server
+func (bc *BoardClient) Reset(board *Board) {
+	bc.Players = make([]*Player, 0)
+	bc.CacheArray = []*Cache{}
+	bc.LastSeq = 0
+	board.Locked = false
+	board.Me.Drawing = false
+	board.Painting = false
+	board.Me.Scribbles = make([]Scribble, 0)
+	board.Me.CachedScribbles = make([]*Cache, 0)
+	board.SelectedBoundingBox = nil
+	board.Changed = true
+}
+
 type Board struct {
 	Width               int32
 	Height              int32
@@ -57,14 +104,28 @@ type Board struct {
 	ColorPicker         ColorPicker
 	ColorPickerOpened   bool
 	SelectedBoundingBox *BoundingBox
+	Stroke              uint32 // numbers our strokes, see common.StartedEvent
+	Painting            bool   // our stroke was started, whether or not the server echoed it yet
+	ListenAddress       string
+	ConnectAddress      string
+	Name                string
+	Password            string // board password or invite, sent on every handshake
+	Room                string // empty joins common.DefaultRoom
+	Spectator           bool   // watch only, the drawing tools are hidden
+	Locked              bool   // only owners can draw, see common.Role.CanDraw
+	Error               string // shown on the join screen, e.g. when the server rejects us
+	Disconnected        bool   // connection lost while drawing, input is disabled
+	DisconnectReason    string
+	Reconnecting        bool
+	SaveRequested       bool
 	Me                  *Player
 	Client              *BoardClient
 }
 
 func NewBoard() *Board {
 	return &Board{
-		Width:         1600,
-		Height:        900,
+		Width:         common.BoardWidth,
+		Height:        common.BoardHeight,
 		LastMousePos:  rl.Vector2{},
 		Changed:       false,
 		PixelSize:     10,
@@ -91,6 +152,17 @@ func NewBoard() *Board {
 		},
 		ColorPickerOpened:   false,
 		SelectedBoundingBox: nil,
+		ListenAddress:       listenAddress,
+		ConnectAddress:      connectAddress,
+		Name:                playerName,
+		Password:            password,
+		Room:                room,
+		Spectator:           spectate,
+		Error:               "",
+		Disconnected:        false,
+		DisconnectReason:    "",
+		Reconnecting:        false,
+		SaveRequested:       false,
 		Me:                  NewPlayer(0),
 		Client:              NewBoardClient(),
 	}
@@ -114,6 +186,9 @@ func (bc *BoardClient) NewCache() *Cache {
 
 type Player struct {
 	Id              int32
+	Name            string
+	Role            common.Role
+	Online          bool // false once the player left, its drawings stay
 	Drawing         bool
 	JustJoined      bool
 	Scribbles       []Scribble
@@ -123,6 +198,9 @@ type Player struct {
 func NewPlayer(id int32) *Player {
 	return &Player{
 		id,
+		"",
+		0,
+		true,
 		false,
 		false,
 		make([]Scribble, 0),
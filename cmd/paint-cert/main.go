@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"main/common"
+)
+
+// paint-cert writes a self-signed certificate for paint-server -tls-cert/-tls-key,
+// clients then join with -tls-ca cert.pem or -tls-pin and the printed fingerprint
+func main() {
+	hosts := flag.String("hosts", "localhost", "Comma separated host names and IPs the certificate is valid for")
+	certFile := flag.String("cert", "cert.pem", "Certificate file to write")
+	keyFile := flag.String("key", "key.pem", "Private key file to write")
+	validFor := flag.Duration("valid-for", 365*24*time.Hour, "How long the certificate is valid")
+	flag.Parse()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"paint"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(*validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		// its own CA, so clients can trust it with -tls-ca
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	for _, host := range strings.Split(*hosts, ",") {
+		host = strings.TrimSpace(host)
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.WriteFile(*certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Wrote", *certFile, "and", *keyFile)
+	fmt.Println("Fingerprint:", common.Fingerprint(der))
+}
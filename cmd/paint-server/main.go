@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"main/server"
+)
+
+func main() {
+	config := server.DefaultConfig()
+	flag.StringVar(&config.Listen, "listen", config.Listen, "Address to listen on (host:port, use :3120 for every interface)")
+	flag.StringVar(&config.WebSocket, "websocket", config.WebSocket, "Address to accept WebSocket clients on (host:port, empty = disabled)")
+	flag.Func("websocket-origins", "Comma separated hosts allowed to open a WebSocket from a browser page", func(origins string) error {
+		config.WebSocketOrigins = strings.Split(origins, ",")
+		return nil
+	})
+	flag.StringVar(&config.TLSCert, "tls-cert", config.TLSCert, "PEM certificate file, enables TLS along with -tls-key (see paint-cert)")
+	flag.StringVar(&config.TLSKey, "tls-key", config.TLSKey, "PEM private key file of -tls-cert")
+	flag.StringVar(&config.Password, "password", config.Password, "Password needed to join the board (empty = open)")
+	invites := flag.Int("invites", 0, "Invite tokens to print, each lets a single player join without the password")
+	flag.IntVar(&config.MaxClients, "max-clients", config.MaxClients, "Maximum simultaneous connections (0 = unlimited)")
+	flag.IntVar(&config.MaxRooms, "max-rooms", config.MaxRooms, "Maximum rooms open at once (0 = unlimited)")
+	flag.IntVar(&config.QueueLimit, "queue-limit", config.QueueLimit, "Frames buffered per client before it's disconnected as too slow")
+	flag.IntVar(&config.History, "history", config.History, "Broadcast frames kept to replay to reconnecting clients")
+	flag.IntVar(&config.MaxFrame, "max-frame", config.MaxFrame, "Largest frame accepted from a client, in bytes")
+	flag.IntVar(&config.Compress, "compress", config.Compress, "Deflate frames above this size in bytes for clients supporting it (0 = never)")
+	flag.Float64Var(&config.EventRate, "event-rate", config.EventRate, "Events per second a client can send (0 = unlimited)")
+	flag.Float64Var(&config.ByteRate, "byte-rate", config.ByteRate, "Bytes per second a client can send (0 = unlimited)")
+	flag.TextVar(&config.Flood, "flood", config.Flood, "What to do with events over the limits: drop, coalesce or disconnect")
+	flag.StringVar(&config.DataDir, "data", config.DataDir, "Directory the boards are saved to and restored from (empty = memory only)")
+	flag.DurationVar(&config.SnapshotInterval, "snapshot-interval", config.SnapshotInterval, "How often a saved board is written whole, changes in between go to its log")
+	flag.DurationVar(&config.HeartbeatInterval, "heartbeat", config.HeartbeatInterval, "Interval between heartbeats")
+	flag.IntVar(&config.HeartbeatMisses, "heartbeat-misses", config.HeartbeatMisses, "Heartbeats a client can miss before it's disconnected")
+	admin := flag.Bool("admin", false, "Read admin commands (kick, unban, rooms) from the terminal, type help for the list")
+	flag.BoolVar(&config.Log, "log", config.Log, "Enable log")
+	flag.BoolVar(&config.LogBytes, "bytes", config.LogBytes, "Enable bytesReceived log")
+	flag.Parse()
+
+	for range *invites {
+		invite := server.NewToken()
+		config.Invites = append(config.Invites, invite)
+		fmt.Println("Invite:", invite)
+	}
+
+	s := server.NewServer(config)
+	if *admin {
+		go s.Admin(os.Stdin, os.Stdout)
+	}
+	if err := s.Start(); err != nil {
+		log.Fatal(err)
+	}
+}
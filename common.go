@@ -1,141 +1,50 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
 	"flag"
-	"image/color"
-	"io"
-	"log"
-	"os"
+
+	"main/common"
 
 	rl "github.com/gen2brain/raylib-go/raylib"
 )
 
 var logEnabled bool
-var bytesReceivedLog bool
-var port = 3120
+var listenAddress string
+var connectAddress string
+var playerName string
+var password string
+var room string
+var spectate bool
+var tlsEnabled bool
+var tlsCA string
+var tlsPin string
 
 func init() {
 	// flag.BoolVar(&logEnabled, "log", false, "Enable log")
-	// flag.BoolVar(&bytesReceivedLog, "bytes", false, "Enable bytesReceived log")
+	flag.StringVar(&listenAddress, "listen", common.DefaultAddress, "Address the server listens on when hosting (host:port)")
+	flag.StringVar(&connectAddress, "connect", common.DefaultAddress, "Address of the board to join (host:port, or a ws:// URL)")
+	flag.StringVar(&playerName, "name", "player", "Name sent to the server when joining")
+	flag.StringVar(&password, "password", "", "Password or invite of the board to join, also protects the board when hosting")
+	flag.StringVar(&room, "room", common.DefaultRoom, "Room of the board to join or host, created if it doesn't exist")
+	flag.BoolVar(&spectate, "spectate", false, "Watch the board without drawing, e.g. to project it")
+	flag.BoolVar(&tlsEnabled, "tls", false, "Connect over TLS, trusting the system certificates")
+	flag.StringVar(&tlsCA, "tls-ca", "", "PEM certificate to trust when connecting over TLS, implies -tls")
+	flag.StringVar(&tlsPin, "tls-pin", "", "SHA-256 fingerprint the server certificate must have, implies -tls")
 	flag.Parse()
 	// clientLogger.enabled = logEnabled
-	// serverLogger.enabled = logEnabled
-
-	// events
-	gob.Register(Event{})
-	gob.Register(JoinedEvent{})
-	gob.Register(LeftEvent{})
-	gob.Register(StartedEvent{})
-	gob.Register(DrawingEvent{})
-	gob.Register(DoneEvent{})
-	gob.Register(PingEvent{})
-	gob.Register(PongEvent{})
-	gob.Register(UndoEvent{})
-	gob.Register(RedoEvent{})
-
-	// nested types (used inside events)
-	gob.Register(Pixel{})
-	gob.Register(rl.Vector2{})
-	gob.Register(rl.Color{})
-	gob.Register(color.RGBA{})
-	gob.Register([]*Pixel{})
-	gob.Register([][]*Pixel{})
-}
-
-type Pixel struct {
-	Center rl.Vector2
-	Radius float32
-	Color  rl.Color
 }
 
 type Scribble struct {
-	Pixels      []*Pixel
+	Pixels      []*common.Pixel
 	Zoom        uint8
 	Position    rl.Vector2
 	BoundingBox BoundingBox
 }
 
-func NewScribble(pixels []*Pixel) Scribble {
+func NewScribble(pixels []*common.Pixel) Scribble {
 	return Scribble{
 		Pixels:   pixels,
 		Zoom:     255,
 		Position: rl.Vector2{},
 	}
 }
-
-type Event struct {
-	PlayerId   int32
-	Kind       string
-	InnerEvent any
-}
-
-type PingEvent struct{}
-
-type PongEvent struct{}
-
-type JoinedEvent struct {
-	Id        int32
-	Drawing   bool
-	Scribbles [][]*Pixel
-} // CHANGE TO HAVE THE DATA OF THE OTHER PLAYER INSIDE IT
-
-type LeftEvent struct{}
-
-type DoneEvent struct{}
-
-type StartedEvent struct{}
-
-type DrawingEvent struct {
-	Pixel *Pixel
-}
-
-type UndoEvent struct{}
-
-type RedoEvent struct {
-	Pixels []*Pixel
-}
-
-// encode an event to bytes
-func Encode(to_encode Event) (*bytes.Buffer, error) {
-	bin_buf := new(bytes.Buffer)
-	gobobj := gob.NewEncoder(bin_buf)
-	err := gobobj.Encode(to_encode)
-	return bin_buf, err
-}
-
-// decode bytes to event
-func Decode(buffer []byte) (*Event, error) {
-	tmpbuffer := bytes.NewBuffer(buffer)
-	gobobj := gob.NewDecoder(tmpbuffer)
-	var event Event
-	err := gobobj.Decode(&event)
-	return &event, err
-}
-
-type Logger struct {
-	logger  *log.Logger
-	enabled bool
-}
-
-func NewLogger(out io.Writer, prefix string, flag int) *Logger {
-	return &Logger{
-		logger:  log.New(os.Stdout, prefix, log.LstdFlags),
-		enabled: false,
-	}
-}
-
-func (l *Logger) Println(v ...any) {
-	if l.enabled {
-		l.logger.Println(v...)
-	}
-}
-
-func Append[T any](array *[]T, toAppend T) {
-	*array = append(*array, toAppend)
-}
-
-func Last[T any](array []T) T {
-	return array[len(array)-1]
-}
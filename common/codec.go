@@ -0,0 +1,593 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+)
+
+// Every frame payload starts with a fixed header:
+//
+//	version   uint8
+//	type      uint8
+//	player id int32
+//
+// followed, for every event but the handshake, by its uint64 sequence
+// number and then the fixed layout of that event type.
+//
+// Pixels are sent as strokes: runs of points sharing a radius and color,
+// which are written once per run, each point being the varint delta from
+// the previous one on a 1/8 pixel grid. A 100 point stroke drawn at a
+// normal pace takes ~230 bytes, down from 1604 with every pixel as
+// float32 x, y, radius and an RGBA color.
+//
+// Ping, pong and error frames are the handshake: their type numbers never
+// change and their layouts only grow at the end, missing trailing fields
+// decode as zero values, so peers of any version can still decode them
+// and tell each other why they can't talk.
+const ProtocolVersion uint8 = 10
+
+const headerSize = 6
+
+// points are quantized to 1/subPixel of a pixel
+const subPixel = 8
+
+// smallest encodings, used to bound counts before allocating
+const pointSize = 2        // two one byte deltas
+const playerStateSize = 13 // id, empty name, role, online, drawing and no scribbles
+
+type EventType uint8
+
+const (
+	PingType EventType = iota + 1
+	PongType
+	SnapshotType
+	LeftType
+	StartedType
+	StrokeChunkType
+	DoneType
+	UndoType
+	RedoType
+	ErrorType
+	HeartbeatType
+	PlayerJoinedType
+	RoleType
+	LockType
+	ClearType
+	KickType
+	PurgeType
+)
+
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+var ErrUnknownEventType = errors.New("unknown event type")
+var ErrShortFrame = errors.New("frame too short")
+var ErrMalformedFrame = errors.New("malformed frame")
+
+// kinds keeps Event.Kind filled on decode, it's not sent on the wire
+var kinds = map[EventType]string{
+	PingType:         "ping",
+	PongType:         "pong",
+	SnapshotType:     "snapshot",
+	LeftType:         "left",
+	StartedType:      "started",
+	StrokeChunkType:  "stroke",
+	DoneType:         "done",
+	UndoType:         "undo",
+	RedoType:         "redo",
+	ErrorType:        "error",
+	HeartbeatType:    "heartbeat",
+	PlayerJoinedType: "player joined",
+	RoleType:         "role",
+	LockType:         "lock",
+	ClearType:        "clear",
+	KickType:         "kick",
+	PurgeType:        "purge",
+}
+
+func isHandshake(eventType EventType) bool {
+	return eventType == PingType || eventType == PongType || eventType == ErrorType
+}
+
+func TypeOf(innerEvent any) (EventType, error) {
+	switch innerEvent.(type) {
+	case PingEvent:
+		return PingType, nil
+	case PongEvent:
+		return PongType, nil
+	case SnapshotEvent:
+		return SnapshotType, nil
+	case PlayerJoinedEvent:
+		return PlayerJoinedType, nil
+	case LeftEvent:
+		return LeftType, nil
+	case StartedEvent:
+		return StartedType, nil
+	case StrokeChunkEvent:
+		return StrokeChunkType, nil
+	case DoneEvent:
+		return DoneType, nil
+	case UndoEvent:
+		return UndoType, nil
+	case RedoEvent:
+		return RedoType, nil
+	case ErrorEvent:
+		return ErrorType, nil
+	case HeartbeatEvent:
+		return HeartbeatType, nil
+	case RoleEvent:
+		return RoleType, nil
+	case LockEvent:
+		return LockType, nil
+	case ClearEvent:
+		return ClearType, nil
+	case KickEvent:
+		return KickType, nil
+	case PurgeEvent:
+		return PurgeType, nil
+	default:
+		return 0, fmt.Errorf("%w: %T", ErrUnknownEventType, innerEvent)
+	}
+}
+
+// encode an event to bytes
+func Encode(toEncode Event) (*bytes.Buffer, error) {
+	eventType, err := TypeOf(toEncode.InnerEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &writer{buf: new(bytes.Buffer)}
+	w.uint8(ProtocolVersion)
+	w.uint8(uint8(eventType))
+	w.int32(toEncode.PlayerId)
+	if !isHandshake(eventType) {
+		w.uint64(toEncode.Seq)
+	}
+
+	switch innerEvent := toEncode.InnerEvent.(type) {
+	case PingEvent:
+		w.uint8(innerEvent.Version)
+		w.uint32(uint32(innerEvent.Capabilities))
+		w.string(innerEvent.Name)
+		w.string(innerEvent.ResumeToken)
+		w.uint64(innerEvent.LastSeq)
+		w.string(innerEvent.Password)
+		w.string(innerEvent.Room)
+		w.bool(innerEvent.Spectator)
+	case PongEvent:
+		w.uint8(innerEvent.Version)
+		w.uint32(uint32(innerEvent.Capabilities))
+		w.string(innerEvent.ResumeToken)
+		w.bool(innerEvent.Resumed)
+		w.uint32(innerEvent.HeartbeatInterval)
+		w.uint8(innerEvent.HeartbeatMisses)
+	case ErrorEvent:
+		w.uint8(uint8(innerEvent.Code))
+		w.string(innerEvent.Message)
+	case SnapshotEvent:
+		w.bool(innerEvent.Locked)
+		w.uint32(uint32(len(innerEvent.Players)))
+		for _, player := range innerEvent.Players {
+			w.int32(player.Id)
+			w.string(player.Name)
+			w.uint8(uint8(player.Role))
+			w.bool(player.Online)
+			w.bool(player.Drawing)
+			w.uint32(uint32(len(player.Scribbles)))
+			for _, scribble := range player.Scribbles {
+				w.stroke(scribble)
+			}
+		}
+	case PlayerJoinedEvent:
+		w.int32(innerEvent.Id)
+		w.string(innerEvent.Name)
+		w.uint8(uint8(innerEvent.Role))
+	case StartedEvent:
+		w.uint32(innerEvent.Stroke)
+	case StrokeChunkEvent:
+		w.uint32(innerEvent.Stroke)
+		w.stroke(innerEvent.Pixels)
+	case RedoEvent:
+		w.stroke(innerEvent.Pixels)
+	case HeartbeatEvent:
+		w.uint64(uint64(innerEvent.SentAt))
+		w.uint64(uint64(innerEvent.RoundTrip))
+	case RoleEvent:
+		w.int32(innerEvent.Id)
+		w.uint8(uint8(innerEvent.Role))
+	case LockEvent:
+		w.bool(innerEvent.Locked)
+	case KickEvent:
+		w.int32(innerEvent.Id)
+		w.string(innerEvent.Reason)
+		w.uint8(uint8(innerEvent.Ban))
+		w.bool(innerEvent.Purge)
+	}
+
+	return w.buf, nil
+}
+
+// decode bytes to event
+func Decode(buffer []byte) (*Event, error) {
+	if len(buffer) < headerSize {
+		return nil, ErrShortFrame
+	}
+
+	eventType := EventType(buffer[1])
+	if buffer[0] != ProtocolVersion && !isHandshake(eventType) {
+		return nil, fmt.Errorf("%w: got %d, want %d", ErrUnsupportedVersion, buffer[0], ProtocolVersion)
+	}
+
+	kind, ok := kinds[eventType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownEventType, eventType)
+	}
+
+	r := &reader{buf: buffer, off: 2}
+	event := &Event{
+		PlayerId: r.int32(),
+		Kind:     kind,
+	}
+	if !isHandshake(eventType) {
+		event.Seq = r.uint64()
+	}
+
+	switch eventType {
+	case PingType:
+		ping := PingEvent{
+			Version:      r.uint8(),
+			Capabilities: Capabilities(r.uint32()),
+			Name:         r.string(),
+		}
+		if r.more() {
+			ping.ResumeToken = r.string()
+			ping.LastSeq = r.uint64()
+		}
+		if r.more() {
+			ping.Password = r.string()
+		}
+		if r.more() {
+			ping.Room = r.string()
+		}
+		if r.more() {
+			ping.Spectator = r.bool()
+		}
+		event.InnerEvent = ping
+	case PongType:
+		pong := PongEvent{
+			Version:      r.uint8(),
+			Capabilities: Capabilities(r.uint32()),
+		}
+		if r.more() {
+			pong.ResumeToken = r.string()
+			pong.Resumed = r.bool()
+		}
+		if r.more() {
+			pong.HeartbeatInterval = r.uint32()
+			pong.HeartbeatMisses = r.uint8()
+		}
+		event.InnerEvent = pong
+	case ErrorType:
+		event.InnerEvent = ErrorEvent{
+			Code:    ErrorCode(r.uint8()),
+			Message: r.string(),
+		}
+	case SnapshotType:
+		locked := r.bool()
+		count := r.count(playerStateSize)
+		snapshot := SnapshotEvent{Locked: locked, Players: make([]PlayerState, 0, count)}
+		for range count {
+			player := PlayerState{
+				Id:      r.int32(),
+				Name:    r.string(),
+				Role:    Role(r.uint8()),
+				Online:  r.bool(),
+				Drawing: r.bool(),
+			}
+			scribbles := r.count(1)
+			player.Scribbles = make([][]*Pixel, 0, scribbles)
+			for range scribbles {
+				Append(&player.Scribbles, r.stroke())
+			}
+			Append(&snapshot.Players, player)
+		}
+		event.InnerEvent = snapshot
+	case PlayerJoinedType:
+		event.InnerEvent = PlayerJoinedEvent{
+			Id:   r.int32(),
+			Name: r.string(),
+			Role: Role(r.uint8()),
+		}
+	case LeftType:
+		event.InnerEvent = LeftEvent{}
+	case StartedType:
+		event.InnerEvent = StartedEvent{Stroke: r.uint32()}
+	case StrokeChunkType:
+		event.InnerEvent = StrokeChunkEvent{
+			Stroke: r.uint32(),
+			Pixels: r.stroke(),
+		}
+	case DoneType:
+		event.InnerEvent = DoneEvent{}
+	case UndoType:
+		event.InnerEvent = UndoEvent{}
+	case RedoType:
+		event.InnerEvent = RedoEvent{Pixels: r.stroke()}
+	case HeartbeatType:
+		event.InnerEvent = HeartbeatEvent{
+			SentAt:    int64(r.uint64()),
+			RoundTrip: int64(r.uint64()),
+		}
+	case RoleType:
+		event.InnerEvent = RoleEvent{
+			Id:   r.int32(),
+			Role: Role(r.uint8()),
+		}
+	case LockType:
+		event.InnerEvent = LockEvent{Locked: r.bool()}
+	case ClearType:
+		event.InnerEvent = ClearEvent{}
+	case KickType:
+		event.InnerEvent = KickEvent{
+			Id:     r.int32(),
+			Reason: r.string(),
+			Ban:    Ban(r.uint8()),
+			Purge:  r.bool(),
+		}
+	case PurgeType:
+		event.InnerEvent = PurgeEvent{}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return event, nil
+}
+
+type writer struct {
+	buf *bytes.Buffer
+}
+
+func (w *writer) uint8(v uint8) {
+	w.buf.WriteByte(v)
+}
+
+func (w *writer) bool(v bool) {
+	if v {
+		w.uint8(1)
+	} else {
+		w.uint8(0)
+	}
+}
+
+func (w *writer) uint16(v uint16) {
+	w.buf.Write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+func (w *writer) uint32(v uint32) {
+	w.buf.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (w *writer) uint64(v uint64) {
+	w.buf.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (w *writer) int32(v int32) {
+	w.uint32(uint32(v))
+}
+
+func (w *writer) float32(v float32) {
+	w.uint32(math.Float32bits(v))
+}
+
+// strings longer than 65535 bytes are truncated
+func (w *writer) string(v string) {
+	if len(v) > math.MaxUint16 {
+		v = v[:math.MaxUint16]
+	}
+	w.uint16(uint16(len(v)))
+	w.buf.WriteString(v)
+}
+
+func (w *writer) uvarint(v uint64) {
+	w.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (w *writer) varint(v int64) {
+	w.buf.Write(binary.AppendVarint(nil, v))
+}
+
+func (w *writer) color(c color.RGBA) {
+	w.buf.Write([]byte{c.R, c.G, c.B, c.A})
+}
+
+func quantize(v float32) int64 {
+	return int64(math.Round(float64(v) * subPixel))
+}
+
+// stroke writes the point count, then the pixels as runs of the same
+// radius and color, the first point of the stroke being a delta from 0,0
+func (w *writer) stroke(pixels []*Pixel) {
+	w.uvarint(uint64(len(pixels)))
+	var x, y int64
+	for start := 0; start < len(pixels); {
+		end := start + 1
+		for end < len(pixels) && pixels[end].Radius == pixels[start].Radius && pixels[end].Color == pixels[start].Color {
+			end++
+		}
+
+		w.float32(pixels[start].Radius)
+		w.color(pixels[start].Color)
+		w.uvarint(uint64(end - start))
+		for _, pixel := range pixels[start:end] {
+			qx, qy := quantize(pixel.Center.X), quantize(pixel.Center.Y)
+			w.varint(qx - x)
+			w.varint(qy - y)
+			x, y = qx, qy
+		}
+		start = end
+	}
+}
+
+// reader keeps the first error and returns zero values afterwards,
+// so Decode only checks once at the end
+type reader struct {
+	buf []byte
+	off int
+	err error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil || len(r.buf)-r.off < n {
+		r.err = ErrShortFrame
+		return nil
+	}
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) bool() bool {
+	return r.uint8() != 0
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *reader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *reader) int32() int32 {
+	return int32(r.uint32())
+}
+
+func (r *reader) float32() float32 {
+	return math.Float32frombits(r.uint32())
+}
+
+// more reports whether there are bytes left, used for fields appended
+// to the handshake layouts by later versions
+func (r *reader) more() bool {
+	return r.err == nil && r.off < len(r.buf)
+}
+
+func (r *reader) string() string {
+	return string(r.next(int(r.uint16())))
+}
+
+// count reads a length prefix and checks that the remaining bytes can hold
+// that many elements of at least minSize bytes, so a corrupt count can't
+// make us allocate more than the frame itself
+func (r *reader) count(minSize int) int {
+	n := int(r.uint32())
+	if r.err == nil && n > (len(r.buf)-r.off)/minSize {
+		r.err = ErrShortFrame
+	}
+	if r.err != nil {
+		return 0
+	}
+	return n
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf[r.off:])
+	if n == 0 {
+		r.err = ErrShortFrame
+	} else if n < 0 {
+		r.err = ErrMalformedFrame
+	}
+	if r.err != nil {
+		return 0
+	}
+	r.off += n
+	return v
+}
+
+func (r *reader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf[r.off:])
+	if n == 0 {
+		r.err = ErrShortFrame
+	} else if n < 0 {
+		r.err = ErrMalformedFrame
+	}
+	if r.err != nil {
+		return 0
+	}
+	r.off += n
+	return v
+}
+
+func (r *reader) color() color.RGBA {
+	b := r.next(4)
+	if b == nil {
+		return color.RGBA{}
+	}
+	return color.RGBA{R: b[0], G: b[1], B: b[2], A: b[3]}
+}
+
+// stroke reads what writer.stroke wrote, a run can't hold more points
+// than the count announced for the whole stroke
+func (r *reader) stroke() []*Pixel {
+	count := r.uvarint()
+	if r.err == nil && count > uint64(len(r.buf)-r.off)/pointSize {
+		r.err = ErrShortFrame
+	}
+	if r.err != nil {
+		return nil
+	}
+	pixels := make([]*Pixel, 0, count)
+	var x, y int64
+	for r.err == nil && uint64(len(pixels)) < count {
+		radius := r.float32()
+		color := r.color()
+		run := r.uvarint()
+		if r.err == nil && (run == 0 || run > count-uint64(len(pixels))) {
+			r.err = ErrMalformedFrame
+		}
+		for i := uint64(0); r.err == nil && i < run; i++ {
+			x += r.varint()
+			y += r.varint()
+			Append(&pixels, &Pixel{
+				Center: Vector2{X: float32(x) / subPixel, Y: float32(y) / subPixel},
+				Radius: radius,
+				Color:  color,
+			})
+		}
+	}
+	return pixels
+}
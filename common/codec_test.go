@@ -0,0 +1,298 @@
+package common
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func stroke(n int) []*Pixel {
+	pixels := make([]*Pixel, 0, n)
+	for i := range n {
+		Append(&pixels, &Pixel{
+			Center: Vector2{X: 100 + float32(i)*1.5, Y: 200 + float32(i%7)*0.25},
+			Radius: 4,
+			Color:  color.RGBA{R: 230, G: 41, B: 55, A: 255},
+		})
+	}
+	return pixels
+}
+
+// events has one event of every type
+var events = []Event{
+	{PlayerId: 3, Kind: "ping", InnerEvent: PingEvent{Version: ProtocolVersion, Name: "painter", Capabilities: SupportedCapabilities, ResumeToken: "token", LastSeq: 42, Password: "secret", Room: "room", Spectator: true}},
+	{PlayerId: 3, Kind: "pong", InnerEvent: PongEvent{Version: ProtocolVersion, Capabilities: CapabilityResume, ResumeToken: "token", Resumed: true, HeartbeatInterval: 2000, HeartbeatMisses: 3}},
+	{Seq: 1, PlayerId: 3, Kind: "snapshot", InnerEvent: SnapshotEvent{Locked: true, Players: []PlayerState{
+		{Id: 0, Name: "owner", Role: RoleOwner, Online: true, Scribbles: [][]*Pixel{stroke(3), stroke(1)}},
+		{Id: 1, Name: "gone", Role: RoleEditor, Drawing: true, Scribbles: [][]*Pixel{}},
+	}}},
+	{Seq: 2, PlayerId: 3, Kind: "left", InnerEvent: LeftEvent{}},
+	{Seq: 3, PlayerId: 3, Kind: "started", InnerEvent: StartedEvent{Stroke: 7}},
+	{Seq: 4, PlayerId: 3, Kind: "stroke", InnerEvent: StrokeChunkEvent{Stroke: 7, Pixels: stroke(10)}},
+	{Seq: 5, PlayerId: 3, Kind: "done", InnerEvent: DoneEvent{}},
+	{Seq: 6, PlayerId: 3, Kind: "undo", InnerEvent: UndoEvent{}},
+	{Seq: 7, PlayerId: 3, Kind: "redo", InnerEvent: RedoEvent{Pixels: stroke(5)}},
+	{PlayerId: -1, Kind: "error", InnerEvent: ErrorEvent{Code: Banned, Message: "banned from this room"}},
+	{Seq: 8, PlayerId: 3, Kind: "heartbeat", InnerEvent: HeartbeatEvent{SentAt: 1 << 60, RoundTrip: 1500}},
+	{Seq: 9, PlayerId: 3, Kind: "player joined", InnerEvent: PlayerJoinedEvent{Id: 4, Name: "newcomer", Role: RoleViewer}},
+	{Seq: 10, PlayerId: 0, Kind: "role", InnerEvent: RoleEvent{Id: 3, Role: RoleViewer}},
+	{Seq: 11, PlayerId: 0, Kind: "lock", InnerEvent: LockEvent{Locked: true}},
+	{Seq: 12, PlayerId: 0, Kind: "clear", InnerEvent: ClearEvent{}},
+	{Seq: 13, PlayerId: 0, Kind: "kick", InnerEvent: KickEvent{Id: 3, Reason: "spam", Ban: BanAddress, Purge: true}},
+	{Seq: 14, PlayerId: 3, Kind: "purge", InnerEvent: PurgeEvent{}},
+}
+
+func TestRoundTrip(t *testing.T) {
+	seen := make(map[EventType]bool)
+	for _, event := range events {
+		eventType, err := TypeOf(event.InnerEvent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[eventType] = true
+
+		encoded, err := Encode(event)
+		if err != nil {
+			t.Fatalf("encoding %s: %v", event.Kind, err)
+		}
+		decoded, err := Decode(encoded.Bytes())
+		if err != nil {
+			t.Fatalf("decoding %s: %v", event.Kind, err)
+		}
+		if !reflect.DeepEqual(*decoded, event) {
+			t.Errorf("%s decoded as %+v, want %+v", event.Kind, *decoded, event)
+		}
+	}
+	for eventType, kind := range kinds {
+		if !seen[eventType] {
+			t.Errorf("no %s event in the round trip", kind)
+		}
+	}
+}
+
+// handshake writes the handshake header of an older or newer peer
+func handshake(version uint8, eventType EventType) *writer {
+	w := &writer{buf: new(bytes.Buffer)}
+	w.uint8(version)
+	w.uint8(uint8(eventType))
+	w.int32(5)
+	return w
+}
+
+func TestDecodeShortHandshake(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame func() *writer
+		want  any
+	}{{
+		name: "ping with a name only",
+		frame: func() *writer {
+			w := handshake(1, PingType)
+			w.uint8(1)
+			w.uint32(0)
+			w.string("old")
+			return w
+		},
+		want: PingEvent{Version: 1, Name: "old"},
+	}, {
+		name: "ping without a password",
+		frame: func() *writer {
+			w := handshake(4, PingType)
+			w.uint8(4)
+			w.uint32(uint32(CapabilityResume))
+			w.string("resuming")
+			w.string("token")
+			w.uint64(9)
+			return w
+		},
+		want: PingEvent{Version: 4, Capabilities: CapabilityResume, Name: "resuming", ResumeToken: "token", LastSeq: 9},
+	}, {
+		name: "ping without a room",
+		frame: func() *writer {
+			w := handshake(5, PingType)
+			w.uint8(5)
+			w.uint32(0)
+			w.string("guest")
+			w.string("")
+			w.uint64(0)
+			w.string("secret")
+			return w
+		},
+		want: PingEvent{Version: 5, Name: "guest", Password: "secret"},
+	}, {
+		name: "ping without spectating",
+		frame: func() *writer {
+			w := handshake(7, PingType)
+			w.uint8(7)
+			w.uint32(0)
+			w.string("guest")
+			w.string("")
+			w.uint64(0)
+			w.string("")
+			w.string("room")
+			return w
+		},
+		want: PingEvent{Version: 7, Name: "guest", Room: "room"},
+	}, {
+		name: "pong with a version only",
+		frame: func() *writer {
+			w := handshake(1, PongType)
+			w.uint8(1)
+			w.uint32(0)
+			return w
+		},
+		want: PongEvent{Version: 1},
+	}, {
+		name: "pong without heartbeats",
+		frame: func() *writer {
+			w := handshake(3, PongType)
+			w.uint8(3)
+			w.uint32(uint32(CapabilityResume))
+			w.string("token")
+			w.bool(true)
+			return w
+		},
+		want: PongEvent{Version: 3, Capabilities: CapabilityResume, ResumeToken: "token", Resumed: true},
+	}, {
+		name: "error of a newer version",
+		frame: func() *writer {
+			w := handshake(ProtocolVersion+1, ErrorType)
+			w.uint8(uint8(VersionMismatch))
+			w.string("upgrade")
+			return w
+		},
+		want: ErrorEvent{Code: VersionMismatch, Message: "upgrade"},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event, err := Decode(test.frame().buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.PlayerId != 5 || !reflect.DeepEqual(event.InnerEvent, test.want) {
+				t.Errorf("decoded %+v, want %+v", event, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsOtherVersions(t *testing.T) {
+	encoded, err := Encode(Event{Kind: "started", InnerEvent: StartedEvent{Stroke: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := encoded.Bytes()
+	frame[0]++
+	if _, err := Decode(frame); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("got %v, want %v", err, ErrUnsupportedVersion)
+	}
+}
+
+// TestStrokeSize records how much the binary encoding saves over gob,
+// which the frames used to be encoded with
+func TestStrokeSize(t *testing.T) {
+	gob.Register(StrokeChunkEvent{})
+	event := Event{Seq: 1, PlayerId: 1, Kind: "stroke", InnerEvent: StrokeChunkEvent{Stroke: 1, Pixels: stroke(100)}}
+
+	var gobFrame bytes.Buffer
+	if err := gob.NewEncoder(&gobFrame).Encode(&event); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := EncodeFrame(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("100 point stroke: gob %d bytes, binary %d bytes", gobFrame.Len(), len(frame))
+	if len(frame) >= gobFrame.Len() {
+		t.Errorf("binary frame of %d bytes isn't smaller than gob's %d", len(frame), gobFrame.Len())
+	}
+}
+
+// FuzzDecode checks that no frame makes Decode panic, and that whatever
+// it accepts encodes back to a frame that decodes the same
+func FuzzDecode(f *testing.F) {
+	for _, event := range events {
+		encoded, err := Encode(event)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(encoded.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		event, err := Decode(frame)
+		if err != nil {
+			return
+		}
+		// the first pass settles the version and the quantized points
+		first, err := Encode(*event)
+		if err != nil {
+			t.Fatalf("decoded %+v doesn't encode: %v", event, err)
+		}
+		again, err := Decode(first.Bytes())
+		if err != nil {
+			t.Fatalf("encoded %+v doesn't decode: %v", event, err)
+		}
+		second, err := Encode(*again)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Errorf("%s changed on a round trip\n%x\n%x", event.Kind, first.Bytes(), second.Bytes())
+		}
+	})
+}
+
+// perPixel is the stroke layout before strokes were delta encoded,
+// every pixel as float32 x, y, radius and an RGBA color
+func perPixel(w *writer, pixels []*Pixel) {
+	w.uint32(uint32(len(pixels)))
+	for _, pixel := range pixels {
+		w.float32(pixel.Center.X)
+		w.float32(pixel.Center.Y)
+		w.float32(pixel.Radius)
+		w.color(pixel.Color)
+	}
+}
+
+func BenchmarkStroke(b *testing.B) {
+	pixels := stroke(100)
+	event := Event{Seq: 1, PlayerId: 1, Kind: "stroke", InnerEvent: StrokeChunkEvent{Stroke: 1, Pixels: pixels}}
+
+	b.Run("delta", func(b *testing.B) {
+		size := 0
+		for range b.N {
+			encoded, err := Encode(event)
+			if err != nil {
+				b.Fatal(err)
+			}
+			size = encoded.Len()
+		}
+		b.ReportMetric(float64(size), "bytes/stroke")
+	})
+	b.Run("per pixel", func(b *testing.B) {
+		size := 0
+		for range b.N {
+			w := &writer{buf: new(bytes.Buffer)}
+			perPixel(w, pixels)
+			size = w.buf.Len()
+		}
+		b.ReportMetric(float64(size), "bytes/stroke")
+	})
+	b.Run("decode", func(b *testing.B) {
+		encoded, err := Encode(event)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for range b.N {
+			if _, err := Decode(encoded.Bytes()); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(encoded.Len()), "bytes/stroke")
+	})
+}
@@ -0,0 +1,322 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"log"
+	"math"
+)
+
+var DefaultPort = 3120
+var DefaultAddress = fmt.Sprintf("localhost:%d", DefaultPort)
+
+// DefaultRoom is joined when the handshake names no room
+const DefaultRoom = "main"
+const MaxRoomName = 64
+
+// Vector2 mirrors rl.Vector2 so the wire types don't depend on raylib,
+// the client converts between them with rl.Vector2(v).
+type Vector2 struct {
+	X float32
+	Y float32
+}
+
+// the board is the client window, pixels are drawn in its coordinates
+const (
+	BoardWidth     = 1600
+	BoardHeight    = 900
+	MaxPixelRadius = 200
+)
+
+var ErrInvalidPixel = errors.New("invalid pixel")
+
+type Pixel struct {
+	Center Vector2
+	Radius float32
+	Color  color.RGBA
+}
+
+// Validate checks what the decoder can't: NaN and infinite floats decode
+// fine, but a pixel must have a sane radius and be drawn on the board
+func (p *Pixel) Validate() error {
+	for _, v := range []float32{p.Center.X, p.Center.Y, p.Radius} {
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return fmt.Errorf("%w: %v is not finite", ErrInvalidPixel, v)
+		}
+	}
+	if p.Radius <= 0 || p.Radius > MaxPixelRadius {
+		return fmt.Errorf("%w: radius %v", ErrInvalidPixel, p.Radius)
+	}
+	if p.Center.X < 0 || p.Center.X > BoardWidth || p.Center.Y < 0 || p.Center.Y > BoardHeight {
+		return fmt.Errorf("%w: center %v outside the board", ErrInvalidPixel, p.Center)
+	}
+	return nil
+}
+
+type Event struct {
+	Seq        uint64 // assigned by the server to broadcast events, 0 otherwise
+	PlayerId   int32
+	Kind       string
+	InnerEvent any
+}
+
+// Capabilities are optional features a peer supports, the server
+// answers the PingEvent with the ones both sides have in common
+type Capabilities uint32
+
+const (
+	// the server issues resume tokens and replays missed events
+	CapabilityResume Capabilities = 1 << iota
+	// the server may deflate large frames, see ReadFrame
+	CapabilityCompression
+)
+
+// SupportedCapabilities is what this build understands
+const SupportedCapabilities = CapabilityResume | CapabilityCompression
+
+func (c Capabilities) Has(capability Capabilities) bool {
+	return c&capability == capability
+}
+
+// a PingEvent with a ResumeToken asks to take back the player it was
+// issued for, LastSeq being the last event the client received.
+// Password is the board password or an invite token, if the board has any,
+// and Room the room to join, created if it doesn't exist yet.
+// A Spectator only watches: it gets the board and everything drawn on it,
+// but isn't a player and can't draw.
+type PingEvent struct {
+	Version      uint8
+	Name         string
+	Capabilities Capabilities
+	ResumeToken  string
+	LastSeq      uint64
+	Password     string
+	Room         string
+	Spectator    bool
+}
+
+// Resumed is false when the session couldn't be resumed (or none was asked),
+// the client then gets the whole board in a SnapshotEvent
+// the client expects a heartbeat every HeartbeatInterval milliseconds
+// and gives up on the server after HeartbeatMisses of them
+type PongEvent struct {
+	Version           uint8
+	Capabilities      Capabilities
+	ResumeToken       string
+	Resumed           bool
+	HeartbeatInterval uint32
+	HeartbeatMisses   uint8
+}
+
+type ErrorCode uint8
+
+const (
+	VersionMismatch ErrorCode = iota + 1
+	ServerFull
+	SlowClient
+	RateLimited
+	Unauthorized
+	RoomUnavailable
+	Kicked
+	Banned
+)
+
+// ErrorEvent is sent by the server right before it closes a connection it refused
+// or evicted
+type ErrorEvent struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Role is what a player may do in its room, the first player
+// of a room is its owner and the ones after it are editors
+type Role uint8
+
+const (
+	RoleViewer Role = iota + 1
+	RoleEditor
+	RoleOwner
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleEditor:
+		return "editor"
+	case RoleOwner:
+		return "owner"
+	default:
+		return fmt.Sprintf("Role(%d)", uint8(r))
+	}
+}
+
+// CanDraw tells whether the role can change the board,
+// owners still can once it's locked
+func (r Role) CanDraw(locked bool) bool {
+	return r == RoleOwner || r == RoleEditor && !locked
+}
+
+// PlayerState is a player as found in a SnapshotEvent
+type PlayerState struct {
+	Id        int32
+	Name      string
+	Role      Role
+	Online    bool
+	Drawing   bool
+	Scribbles [][]*Pixel
+}
+
+// SnapshotEvent is the whole board, sent only to a client that has none,
+// players are in id order and departed ones are included since their
+// drawings are still part of the board
+type SnapshotEvent struct {
+	Locked  bool
+	Players []PlayerState
+}
+
+// PlayerJoinedEvent tells everyone else a player is (back) on the board
+type PlayerJoinedEvent struct {
+	Id   int32
+	Name string
+	Role Role
+}
+
+// the events below are sent by the owner, the server checks the role
+// of the sender and broadcasts the role and lock changes to everyone
+
+// RoleEvent gives player Id a new role
+type RoleEvent struct {
+	Id   int32
+	Role Role
+}
+
+// LockEvent stops everyone but the owners from drawing, or lets them again
+type LockEvent struct {
+	Locked bool
+}
+
+// ClearEvent removes every drawing from the board, it can't be undone
+type ClearEvent struct{}
+
+// Ban is what keeps a kicked player out of the room
+type Ban uint8
+
+const (
+	BanNone Ban = iota
+	// its resume token is refused, it can still join as a new player
+	BanToken
+	// its token and anything from its address are refused
+	BanAddress
+)
+
+var bans = map[Ban]string{
+	BanNone:    "none",
+	BanToken:   "token",
+	BanAddress: "address",
+}
+
+func (b Ban) String() string {
+	return bans[b]
+}
+
+func (b Ban) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *Ban) UnmarshalText(text []byte) error {
+	for ban, name := range bans {
+		if name == string(text) {
+			*b = ban
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown ban %q, want none, token or address", text)
+}
+
+// KickEvent closes the connection of player Id with the reason, only the
+// server sees it. Purge also removes every drawing of the player.
+type KickEvent struct {
+	Id     int32
+	Reason string
+	Ban    Ban
+	Purge  bool
+}
+
+// PurgeEvent removes every drawing of the player, after it was kicked
+type PurgeEvent struct{}
+
+type LeftEvent struct{}
+
+type DoneEvent struct{}
+
+// Stroke numbers the strokes of a player, the chunks that follow
+// carry it so late ones can't end up in the next stroke
+type StartedEvent struct {
+	Stroke uint32
+}
+
+// StrokeChunkEvent carries the pixels of a stroke drawn since the last
+// send tick, the server appends them to the player's current scribble
+type StrokeChunkEvent struct {
+	Stroke uint32
+	Pixels []*Pixel
+}
+
+// MergeChunk appends the pixels of event to last when both are chunks of the
+// same stroke, so a tick worth of samples goes out as a single frame
+func MergeChunk(last *Event, event *Event) bool {
+	lastChunk, ok := last.InnerEvent.(StrokeChunkEvent)
+	if !ok || last.PlayerId != event.PlayerId {
+		return false
+	}
+	chunk, ok := event.InnerEvent.(StrokeChunkEvent)
+	if !ok || chunk.Stroke != lastChunk.Stroke {
+		return false
+	}
+	lastChunk.Pixels = append(lastChunk.Pixels, chunk.Pixels...)
+	last.InnerEvent = lastChunk
+	return true
+}
+
+// HeartbeatEvent is sent by the server every heartbeat interval and echoed
+// back by the client, SentAt is the server clock in unix nanoseconds and
+// RoundTrip the last round trip the server measured for that client
+type HeartbeatEvent struct {
+	SentAt    int64
+	RoundTrip int64
+}
+
+type UndoEvent struct{}
+
+type RedoEvent struct {
+	Pixels []*Pixel
+}
+
+type Logger struct {
+	logger  *log.Logger
+	Enabled bool
+}
+
+func NewLogger(out io.Writer, prefix string, flag int) *Logger {
+	return &Logger{
+		logger:  log.New(out, prefix, flag),
+		Enabled: false,
+	}
+}
+
+func (l *Logger) Println(v ...any) {
+	if l.Enabled {
+		l.logger.Println(v...)
+	}
+}
+
+func Append[T any](array *[]T, toAppend T) {
+	*array = append(*array, toAppend)
+}
+
+func Last[T any](array []T) T {
+	return array[len(array)-1]
+}
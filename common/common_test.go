@@ -0,0 +1,44 @@
+package common
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestPixelValidate(t *testing.T) {
+	nan := float32(math.NaN())
+	inf := float32(math.Inf(1))
+	tests := []struct {
+		name   string
+		center Vector2
+		radius float32
+		valid  bool
+	}{
+		{"inside", Vector2{X: 800, Y: 450}, 4, true},
+		{"top left corner", Vector2{}, 1, true},
+		{"bottom right corner", Vector2{X: BoardWidth, Y: BoardHeight}, MaxPixelRadius, true},
+		{"NaN x", Vector2{X: nan, Y: 10}, 4, false},
+		{"NaN radius", Vector2{X: 10, Y: 10}, nan, false},
+		{"infinite y", Vector2{X: 10, Y: inf}, 4, false},
+		{"negative infinite x", Vector2{X: -inf, Y: 10}, 4, false},
+		{"infinite radius", Vector2{X: 10, Y: 10}, inf, false},
+		{"radius 0", Vector2{X: 10, Y: 10}, 0, false},
+		{"negative radius", Vector2{X: 10, Y: 10}, -4, false},
+		{"huge radius", Vector2{X: 10, Y: 10}, MaxPixelRadius + 1, false},
+		{"left of the board", Vector2{X: -1, Y: 10}, 4, false},
+		{"right of the board", Vector2{X: BoardWidth + 1, Y: 10}, 4, false},
+		{"above the board", Vector2{X: 10, Y: -0.5}, 4, false},
+		{"below the board", Vector2{X: 10, Y: BoardHeight + 1}, 4, false},
+	}
+	for _, test := range tests {
+		pixel := Pixel{Center: test.center, Radius: test.radius}
+		err := pixel.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidPixel) {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrInvalidPixel)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/coder/websocket"
+)
+
+// Dial connects to a server, over WebSocket when the address is a ws:// or
+// wss:// URL and over TCP otherwise, frames are the same either way.
+// A nil tlsConfig means plaintext TCP, WebSocket follows the URL scheme.
+func Dial(address string, tlsConfig *tls.Config) (net.Conn, error) {
+	if !strings.HasPrefix(address, "ws://") && !strings.HasPrefix(address, "wss://") {
+		if tlsConfig != nil {
+			return tls.Dial("tcp", address, tlsConfig)
+		}
+		return net.Dial("tcp", address)
+	}
+
+	options := &websocket.DialOptions{}
+	if tlsConfig != nil {
+		options.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+	}
+	c, _, err := websocket.Dial(context.Background(), address, options)
+	if err != nil {
+		return nil, err
+	}
+	return websocket.NetConn(context.Background(), c, websocket.MessageBinary), nil
+}
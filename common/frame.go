@@ -0,0 +1,95 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultMaxFrameSize bounds what a server accepts from a client, whose
+// frames are a single event and never hold more than a few pixels
+const DefaultMaxFrameSize = 64 << 10
+
+// DefaultCompressThreshold is the frame size above which compressing is worth it
+const DefaultCompressThreshold = 4 << 10
+
+// the top bit of the length prefix marks a deflated payload
+const compressedFlag = 1 << 31
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// EncodeFrame encodes an event prefixed with its int32 big endian length,
+// ready to be sent with a single Write
+func EncodeFrame(event Event) ([]byte, error) {
+	encodedEvent, err := Encode(event)
+	if err != nil {
+		return nil, err
+	}
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+encodedEvent.Len()), uint32(encodedEvent.Len()))
+	return append(frame, encodedEvent.Bytes()...), nil
+}
+
+func WriteFrame(w io.Writer, event Event) error {
+	frame, err := EncodeFrame(event)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+// CompressFrame deflates the payload of a frame made by EncodeFrame,
+// it's only sent to peers that negotiated CapabilityCompression
+func CompressFrame(frame []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 4, len(frame)/2))
+	zw, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(frame[4:]); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	compressed := buf.Bytes()
+	binary.BigEndian.PutUint32(compressed, uint32(len(compressed)-4)|compressedFlag)
+	return compressed, nil
+}
+
+// ReadFrame reads one length prefixed frame, refusing lengths above maxSize
+// before allocating anything for it, compressed frames are inflated
+// and held to the same bound
+func ReadFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var prefix uint32
+	if err := binary.Read(r, binary.BigEndian, &prefix); err != nil {
+		return nil, err
+	}
+	length := prefix &^ compressedFlag
+	if int64(length) > int64(maxSize) {
+		return nil, fmt.Errorf("%w: %d bytes, max %d", ErrFrameTooLarge, length, maxSize)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if prefix&compressedFlag == 0 {
+		return buf, nil
+	}
+
+	zr := flate.NewReader(bytes.NewReader(buf))
+	defer zr.Close()
+	inflated, err := io.ReadAll(io.LimitReader(zr, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(inflated) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes once inflated", ErrFrameTooLarge, maxSize)
+	}
+	return inflated, nil
+}
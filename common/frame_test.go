@@ -0,0 +1,70 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// FuzzReadFrame checks that no input makes ReadFrame panic
+// or return more than it was allowed to
+func FuzzReadFrame(f *testing.F) {
+	const maxSize = 4 << 10
+	for _, event := range events {
+		frame, err := EncodeFrame(event)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(frame)
+	}
+	frame, err := EncodeFrame(Event{Seq: 1, Kind: "redo", InnerEvent: RedoEvent{Pixels: stroke(200)}})
+	if err != nil {
+		f.Fatal(err)
+	}
+	compressed, err := CompressFrame(frame)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(compressed)
+	f.Add(binary.BigEndian.AppendUint32(nil, maxSize+1))
+	f.Add(binary.BigEndian.AppendUint32(nil, compressedFlag|8))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		buf, err := ReadFrame(bytes.NewReader(data), maxSize)
+		if err != nil {
+			return
+		}
+		if len(buf) > maxSize {
+			t.Errorf("read a frame of %d bytes, max %d", len(buf), maxSize)
+		}
+	})
+}
+
+func TestReadFrame(t *testing.T) {
+	var stream bytes.Buffer
+	for _, event := range events {
+		frame, err := EncodeFrame(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Kind == "snapshot" {
+			if frame, err = CompressFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stream.Write(frame)
+	}
+	for _, event := range events {
+		buf, err := ReadFrame(&stream, DefaultMaxFrameSize)
+		if err != nil {
+			t.Fatalf("reading %s: %v", event.Kind, err)
+		}
+		decoded, err := Decode(buf)
+		if err != nil {
+			t.Fatalf("decoding %s: %v", event.Kind, err)
+		}
+		if decoded.Kind != event.Kind {
+			t.Errorf("read %s, want %s", decoded.Kind, event.Kind)
+		}
+	}
+}
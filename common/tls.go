@@ -0,0 +1,53 @@
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrFingerprintMismatch = errors.New("server certificate doesn't match the pinned fingerprint")
+
+// Fingerprint is the hex SHA-256 of a DER certificate, as printed by paint-cert
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientTLS builds the client TLS config, nil when TLS is off. caFile adds
+// a certificate to trust, a pinned fingerprint replaces the verification
+// altogether, which is what self-signed certificates on a LAN need.
+func ClientTLS(enabled bool, caFile string, pin string) (*tls.Config, error) {
+	if !enabled && caFile == "" && pin == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if pin != "" {
+		pin = strings.ToLower(strings.ReplaceAll(pin, ":", ""))
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || Fingerprint(rawCerts[0]) != pin {
+				return ErrFingerprintMismatch
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
@@ -2,7 +2,10 @@ module main
 
 go 1.22.5
 
-require github.com/gen2brain/raylib-go/raylib v0.0.0-20240628125141-62016ee92fc0
+require (
+	github.com/coder/websocket v1.8.13
+	github.com/gen2brain/raylib-go/raylib v0.0.0-20240628125141-62016ee92fc0
+)
 
 require (
 	github.com/ebitengine/purego v0.7.1 // indirect
@@ -2,13 +2,24 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"math"
+	"net"
+	"time"
+
+	"main/common"
+	"main/server"
 
 	rl "github.com/gen2brain/raylib-go/raylib"
 )
 
 func main() {
 	board := NewBoard()
+	tlsConfig, err := common.ClientTLS(tlsEnabled, tlsCA, tlsPin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	board.Client.TLS = tlsConfig
 
 	rl.SetTraceLogLevel(rl.LogError)
 	rl.InitWindow(board.Width, board.Height, "Paint")
@@ -28,6 +39,17 @@ func main() {
 	buttonHeight := 100
 	serverButton := NewButton(halfScreenW, halfScreenH-(buttonHeight/2)-20, buttonWidth, buttonHeight, rl.Black, "Host", 40)
 	clientButton := NewButton(halfScreenW, halfScreenH+(buttonHeight/2)+20, buttonWidth, buttonHeight, rl.Black, "Enter", 40)
+	inputWidth := 340
+	addressInput := NewTextInput(halfScreenW+(buttonWidth/2)+20+(inputWidth/2), halfScreenH+(buttonHeight/2)+20, inputWidth, buttonHeight, board.ConnectAddress, 30)
+	// between the buttons since it's used both to host and to enter
+	passwordInput := NewTextInput(halfScreenW+(buttonWidth/2)+20+(inputWidth/2), halfScreenH-(buttonHeight/2)-20, inputWidth, buttonHeight, board.Password, 30)
+	passwordInput.Label = "Password (optional)"
+	passwordInput.Masked = true
+	// on the other side, also used both to host and to enter
+	roomInput := NewTextInput(halfScreenW-(buttonWidth/2)-20-(inputWidth/2), halfScreenH-(buttonHeight/2)-20, inputWidth, buttonHeight, board.Room, 30)
+	roomInput.Label = "Room"
+	reconnectButton := NewButton(halfScreenW-130, 110, 240, 50, rl.Black, "Reconnect", 30)
+	saveButton := NewButton(halfScreenW+130, 110, 240, 50, rl.Black, "Save", 30)
 
 	for !rl.WindowShouldClose() {
 		board.FrameCount++
@@ -35,7 +57,7 @@ func main() {
 		// else: start paint screen
 		rl.BeginDrawing()
 		if board.UiMode {
-			board.DrawUIMode(serverButton, clientButton)
+			board.DrawUIMode(serverButton, clientButton, &addressInput, &passwordInput, &roomInput)
 		}
 
 		if !board.UiMode {
@@ -43,6 +65,10 @@ func main() {
 			board.Draw(target)
 		}
 
+		if !board.UiMode && board.Disconnected {
+			board.DrawDisconnected(reconnectButton, saveButton)
+		}
+
 		if board.FrameCount == board.FPS/board.FrameSpeed {
 			board.FrameCount = 0
 		}
@@ -50,19 +76,38 @@ func main() {
 	}
 
 	// close the application window so they left
-	board.Client.EnqueueEvent(board.Me.Id, "left", LeftEvent{})
-	board.Wg.Wait()
+	board.Leave()
 }
 
 func (b *Board) Input() {
-	b.HandlePainting()
+	// spectators only watch, there are no tools to handle
+	if b.Spectator {
+		return
+	}
+
 	b.HandleColorPicker()
 
+	// nothing can be sent while disconnected
+	if b.Disconnected {
+		return
+	}
+
+	if b.CanDraw() {
+		b.HandlePainting()
+	} else {
+		// the server already ended the stroke when we lost the right to draw
+		b.Painting = false
+	}
+
+	if b.Me.Role == common.RoleOwner {
+		b.HandleModeration()
+	}
+
 	if rl.IsMouseButtonPressed(rl.MouseButtonRight) {
 		go b.IsMouseClickOnScribble(rl.GetMousePosition())
 	}
 
-	if rl.IsKeyDown(rl.KeyEqual) && b.FrameCount == b.FPS/b.FrameSpeed {
+	if rl.IsKeyDown(rl.KeyEqual) && b.PixelSize < common.MaxPixelRadius && b.FrameCount == b.FPS/b.FrameSpeed {
 		b.PixelSize++
 	}
 
@@ -70,12 +115,13 @@ func (b *Board) Input() {
 		b.PixelSize--
 	}
 
-	if rl.IsKeyPressed(rl.KeyU) {
-		b.Client.EnqueueEvent(b.Me.Id, "undo", UndoEvent{})
+	// the server ignores them in the middle of a stroke
+	if rl.IsKeyPressed(rl.KeyU) && b.CanDraw() && !b.Painting {
+		b.Client.EnqueueEvent(b.Me.Id, "undo", common.UndoEvent{})
 	}
 
-	if rl.IsKeyPressed(rl.KeyR) {
-		b.Client.EnqueueEvent(b.Me.Id, "redo", RedoEvent{})
+	if rl.IsKeyPressed(rl.KeyR) && b.CanDraw() && !b.Painting {
+		b.Client.EnqueueEvent(b.Me.Id, "redo", common.RedoEvent{})
 	}
 
 	// debug purposes
@@ -87,20 +133,88 @@ func (b *Board) Input() {
 
 // Draw
 
-func (b *Board) DrawUIMode(serverButton Button, clientButton Button) {
+func (b *Board) DrawUIMode(serverButton Button, clientButton Button, addressInput *TextInput, passwordInput *TextInput, roomInput *TextInput) {
 	rl.ClearBackground(rl.White)
+	if b.Error != "" {
+		textWidth := rl.MeasureText(b.Error, 20)
+		rl.DrawText(b.Error, int32(rl.GetScreenWidth())/2-textWidth/2, 40, 20, rl.Red)
+	}
+
 	serverButton.Draw()
 	serverButton.Click(func() {
-		go StartServer()
-		go b.StartClient()
+		b.Error = ""
+		b.Password = passwordInput.Text
+		b.Room = roomInput.Text
+		config := server.DefaultConfig()
+		config.Listen = b.ListenAddress
+		config.Password = b.Password
+		// listen before the client dials it
+		ln, err := net.Listen("tcp", config.Listen)
+		if err != nil {
+			b.Error = err.Error()
+			return
+		}
+		go func() {
+			if err := server.NewServer(config).Serve(ln); err != nil {
+				b.Client.Logger.Println("Server stopped", err)
+			}
+		}()
+		// the hosted server is plaintext, whatever we'd use to join others
+		b.Client.TLS = nil
+		go b.Join(DialAddress(b.ListenAddress))
 		b.UiMode = false
 	})
 
 	clientButton.Draw()
 	clientButton.Click(func() {
-		go b.StartClient()
+		b.Error = ""
+		b.ConnectAddress = addressInput.Text
+		b.Password = passwordInput.Text
+		b.Room = roomInput.Text
+		go b.Join(b.ConnectAddress)
 		b.UiMode = false
 	})
+
+	addressInput.Update()
+	addressInput.Draw()
+	passwordInput.Update()
+	passwordInput.Draw()
+	roomInput.Update()
+	roomInput.Draw()
+}
+
+// DrawDisconnected draws a banner over the board offering to reconnect
+// or to save what's on screen
+func (b *Board) DrawDisconnected(reconnectButton Button, saveButton Button) {
+	if b.SaveRequested {
+		// taken before the banner is drawn so it isn't in the picture
+		fileName := fmt.Sprintf("board-%s.png", time.Now().Format("20060102-150405"))
+		rl.TakeScreenshot(fileName)
+		b.DisconnectReason = "saved " + fileName
+		b.SaveRequested = false
+	}
+
+	rl.DrawRectangle(0, 0, b.Width, 150, rl.Fade(rl.Red, 0.85))
+	text := "Disconnected: " + b.DisconnectReason
+	if b.Reconnecting {
+		text = "Reconnecting..."
+	}
+	textWidth := rl.MeasureText(text, 30)
+	rl.DrawText(text, b.Width/2-textWidth/2, 25, 30, rl.White)
+
+	if b.Reconnecting {
+		return
+	}
+
+	reconnectButton.Draw()
+	reconnectButton.Click(func() {
+		go b.ManualReconnect()
+	})
+
+	saveButton.Draw()
+	saveButton.Click(func() {
+		b.SaveRequested = true
+	})
 }
 
 func (b *Board) Draw(target rl.RenderTexture2D) {
@@ -120,7 +234,9 @@ func (b *Board) Draw(target rl.RenderTexture2D) {
 		b.ColorPicker.Draw()
 	}
 
-	rl.DrawCircleLines(rl.GetMouseX(), rl.GetMouseY(), b.PixelSize, rl.Black)
+	if !b.Spectator {
+		rl.DrawCircleLines(rl.GetMouseX(), rl.GetMouseY(), b.PixelSize, rl.Black)
+	}
 	rl.DrawFPS(b.Width-200, 20)
 
 	mouseXText := fmt.Sprintf("Mouse X: %d", int(rl.GetMousePosition().X))
@@ -128,18 +244,93 @@ func (b *Board) Draw(target rl.RenderTexture2D) {
 	rl.DrawText(mouseXText, b.Width-200, 40, 20, rl.Black)
 	rl.DrawText(mouseYText, b.Width-200, 60, 20, rl.Black)
 
+	pingText := fmt.Sprintf("Ping: %d ms", b.Client.RoundTrip.Milliseconds())
+	rl.DrawText(pingText, b.Width-200, 80, 20, rl.Black)
+
+	if b.Spectator {
+		rl.DrawText("Spectating", 10, 10, 20, b.CONFIG_COLOR)
+		return
+	}
+
 	pencilSizeText := fmt.Sprintf("Pencil size: %d", int(b.PixelSize))
 	rl.DrawText(pencilSizeText, 10, 10, 20, b.CONFIG_COLOR)
 
 	rl.DrawText("Selected color: ", 10, 40, 20, b.CONFIG_COLOR)
 	rl.DrawCircle(180, 50, 10, b.SelectedColor)
+
+	b.DrawPlayerList()
+}
+
+// the player list is drawn under the pencil settings, one row per online player
+const (
+	playerListX     = 10
+	playerListY     = 80
+	playerListWidth = 300
+	playerListRowH  = 24
+	ownerHelpText   = "Over a player E: editor/viewer  O: owner  K: kick  B: ban  (Shift: erase its drawings)   L: lock  Delete: clear"
+)
+
+// OnlinePlayers are the players shown in the list, in id order
+func (b *Board) OnlinePlayers() []*Player {
+	players := make([]*Player, 0, len(b.Client.Players))
+	for _, player := range b.Client.Players {
+		if player.Online {
+			players = append(players, player)
+		}
+	}
+	return players
+}
+
+// HoveredPlayer is the player of the list under the mouse, if any
+func (b *Board) HoveredPlayer() *Player {
+	mouse := rl.GetMousePosition()
+	// the first row is the title
+	row := int(mouse.Y-playerListY)/playerListRowH - 1
+	if mouse.X < playerListX || mouse.X > playerListX+playerListWidth || mouse.Y < playerListY || row < 0 {
+		return nil
+	}
+	players := b.OnlinePlayers()
+	if row >= len(players) {
+		return nil
+	}
+	return players[row]
+}
+
+func (b *Board) DrawPlayerList() {
+	title := "Players"
+	if b.Locked {
+		title = "Players (board locked)"
+	}
+	rl.DrawText(title, playerListX, playerListY, 20, b.CONFIG_COLOR)
+
+	owner := b.Me.Role == common.RoleOwner
+	hovered := b.HoveredPlayer()
+	for i, player := range b.OnlinePlayers() {
+		y := int32(playerListY + (i+1)*playerListRowH)
+		if owner && player == hovered {
+			rl.DrawRectangle(playerListX, y-2, playerListWidth, playerListRowH, rl.LightGray)
+		}
+		name := player.Name
+		if name == "" {
+			name = fmt.Sprintf("player %d", player.Id)
+		}
+		text := fmt.Sprintf("%s (%s)", name, player.Role)
+		if player == b.Me {
+			text += " - you"
+		}
+		rl.DrawText(text, playerListX, y, 20, rl.Black)
+	}
+
+	if owner {
+		rl.DrawText(ownerHelpText, playerListX, b.Height-30, 20, rl.Gray)
+	}
 }
 
 func (b *Board) DrawBoard() {
 	if b.Changed {
 		for _, player := range b.Client.Players {
 			if player.Drawing {
-				currentlyDrawingArray := Last(player.Scribbles)
+				currentlyDrawingArray := common.Last(player.Scribbles)
 				cache := b.GetCache(player, len(player.CachedScribbles)-1)
 				if cache == nil {
 					panic("Cache nil")
@@ -168,19 +359,19 @@ func (b *Board) DrawBoard() {
 	b.Changed = false
 }
 
-func DrawScribble(scribble []*Pixel, renderTexture2D rl.RenderTexture2D) {
+func DrawScribble(scribble []*common.Pixel, renderTexture2D rl.RenderTexture2D) {
 	rl.BeginTextureMode(renderTexture2D)
 	rl.ClearBackground(rl.Blank)
-	var lastPixelLoop *Pixel
+	var lastPixelLoop *common.Pixel
 	for i, pixel := range scribble {
-		rl.DrawCircleV(pixel.Center, pixel.Radius, pixel.Color)
+		rl.DrawCircleV(rl.Vector2(pixel.Center), pixel.Radius, pixel.Color)
 		// Draws a line between the last and newest pixel
 		if i > 0 && lastPixelLoop != nil {
-			rl.DrawLineEx(pixel.Center, lastPixelLoop.Center, pixel.Radius*2, pixel.Color)
+			rl.DrawLineEx(rl.Vector2(pixel.Center), rl.Vector2(lastPixelLoop.Center), pixel.Radius*2, pixel.Color)
 		}
 		lastPixelLoop = pixel
 	}
-	lastPixelLoop = &Pixel{}
+	lastPixelLoop = &common.Pixel{}
 	rl.EndTextureMode()
 }
 
@@ -205,29 +396,80 @@ func (b *Board) DrawCache() {
 	}
 }
 
+// CanDraw tells whether the server takes our strokes, our role
+// may not allow it or the board may be locked
+func (b *Board) CanDraw() bool {
+	return b.Me.Role.CanDraw(b.Locked)
+}
+
+// HandleModeration lets the owner manage the room, see ownerHelpText
+func (b *Board) HandleModeration() {
+	if player := b.HoveredPlayer(); player != nil && player != b.Me {
+		if rl.IsKeyPressed(rl.KeyE) {
+			role := common.RoleViewer
+			if player.Role == common.RoleViewer {
+				role = common.RoleEditor
+			}
+			b.Client.EnqueueEvent(b.Me.Id, "role", common.RoleEvent{Id: player.Id, Role: role})
+		}
+		if rl.IsKeyPressed(rl.KeyO) {
+			b.Client.EnqueueEvent(b.Me.Id, "role", common.RoleEvent{Id: player.Id, Role: common.RoleOwner})
+		}
+		// with shift held the drawings of the player go too
+		purge := rl.IsKeyDown(rl.KeyLeftShift) || rl.IsKeyDown(rl.KeyRightShift)
+		if rl.IsKeyPressed(rl.KeyK) {
+			b.Client.EnqueueEvent(b.Me.Id, "kick", common.KickEvent{
+				Id:     player.Id,
+				Reason: "kicked by the owner",
+				Purge:  purge,
+			})
+		}
+		if rl.IsKeyPressed(rl.KeyB) {
+			b.Client.EnqueueEvent(b.Me.Id, "kick", common.KickEvent{
+				Id:     player.Id,
+				Reason: "banned by the owner",
+				Ban:    common.BanAddress,
+				Purge:  purge,
+			})
+		}
+	}
+
+	if rl.IsKeyPressed(rl.KeyL) {
+		b.Client.EnqueueEvent(b.Me.Id, "lock", common.LockEvent{Locked: !b.Locked})
+	}
+	if rl.IsKeyPressed(rl.KeyDelete) {
+		b.Client.EnqueueEvent(b.Me.Id, "clear", common.ClearEvent{})
+	}
+}
+
 func (b *Board) HandlePainting() {
 	if rl.IsMouseButtonDown(rl.MouseButtonLeft) {
-		mousePos := rl.GetMousePosition()
-		fmt.Println("pixelSize", b.PixelSize)
-		newPixel := Pixel{
-			mousePos,
-			b.PixelSize,
-			b.SelectedColor,
+		// the mouse keeps moving outside the window while the button is held
+		mousePos := rl.Vector2Clamp(rl.GetMousePosition(), rl.Vector2{}, rl.Vector2{X: float32(b.Width), Y: float32(b.Height)})
+		newPixel := common.Pixel{
+			Center: common.Vector2(mousePos),
+			Radius: b.PixelSize,
+			Color:  b.SelectedColor,
 		}
 
-		// avoid send redundant events, otherwise, drawing will be true
-		// as long as the player hold the mouse button
-		// so it would send these events again
-		if !b.Me.Drawing {
-			b.Client.EnqueueEvent(b.Me.Id, "started", StartedEvent{})
-		} else if newPixel.Center != b.LastMousePos {
-			b.Client.EnqueueEvent(b.Me.Id, "drawing", DrawingEvent{Pixel: &newPixel})
-			b.LastMousePos = mousePos
-		}
-	} else {
-		if b.Me.Drawing {
-			b.Client.EnqueueEvent(b.Me.Id, "done", DoneEvent{})
+		// the echo of our StartedEvent comes back a round trip later,
+		// waiting for it would start the stroke again on every frame
+		if !b.Painting {
+			b.Painting = true
+			b.Stroke++
+			b.Client.EnqueueEvent(b.Me.Id, "started", common.StartedEvent{Stroke: b.Stroke})
+		} else if rl.Vector2(newPixel.Center) == b.LastMousePos {
+			return
 		}
+		// merged with the other samples of the send tick into one chunk
+		b.Client.EnqueueEvent(b.Me.Id, "stroke", common.StrokeChunkEvent{
+			Stroke: b.Stroke,
+			Pixels: []*common.Pixel{&newPixel},
+		})
+		b.LastMousePos = mousePos
+	} else if b.Painting {
+		b.Painting = false
+		b.Client.EnqueueEvent(b.Me.Id, "done", common.DoneEvent{})
 	}
 }
 
@@ -333,7 +575,7 @@ func (b *Board) IsMouseClickOnScribble(clickPositon rl.Vector2) {
 	}
 }
 
-func GetMinAndMax(min rl.Vector3, max rl.Vector3, pixel *Pixel) (rl.Vector3, rl.Vector3) {
+func GetMinAndMax(min rl.Vector3, max rl.Vector3, pixel *common.Pixel) (rl.Vector3, rl.Vector3) {
 	if min.X > pixel.Center.X {
 		min.X = pixel.Center.X
 	}
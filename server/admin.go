@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"main/common"
+)
+
+const adminHelp = `Commands:
+  rooms                                     list the rooms, who's in them and the bans
+  kick [-ban token|address] [-purge] ROOM ID [REASON]
+                                            disconnect a player, -ban keeps it out
+                                            and -purge erases its drawings
+  unban ROOM ADDRESS|TOKEN                  let a banned player back in
+  help                                      show this`
+
+var errUsage = errors.New("wrong arguments, see help")
+
+// Admin runs the commands read from in, one per line, and writes what they
+// did to out, paint-server -admin reads them from the terminal
+func (s *Server) Admin(in io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if err := s.Command(args, out); err != nil {
+			fmt.Fprintln(out, "Error:", err)
+		}
+	}
+}
+
+// Command runs a single admin command, see adminHelp
+func (s *Server) Command(args []string, out io.Writer) error {
+	switch args[0] {
+	case "help":
+		fmt.Fprintln(out, adminHelp)
+		return nil
+	case "rooms":
+		s.ListRooms(out)
+		return nil
+	case "kick":
+		flags := flag.NewFlagSet("kick", flag.ContinueOnError)
+		flags.SetOutput(out)
+		var ban common.Ban
+		flags.TextVar(&ban, "ban", common.BanNone, "Keep the player out: none, token or address")
+		purge := flags.Bool("purge", false, "Erase the drawings of the player")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() < 2 {
+			return errUsage
+		}
+		id, err := strconv.ParseInt(flags.Arg(1), 10, 32)
+		if err != nil {
+			return err
+		}
+		reason := strings.Join(flags.Args()[2:], " ")
+		if reason == "" {
+			reason = "kicked by the server admin"
+		}
+
+		room, err := s.lookup(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		closed := !room.Do(func() {
+			err = room.Kick(int32(id), reason, ban, *purge)
+		})
+		if closed {
+			return fmt.Errorf("%w: %s", ErrNoRoom, room.Name)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Kicked player", id, "from room", room.Name)
+		return nil
+	case "unban":
+		if len(args) != 3 {
+			return errUsage
+		}
+		room, err := s.lookup(args[1])
+		if err != nil {
+			return err
+		}
+		var unbanned bool
+		if !room.Do(func() {
+			unbanned = room.Unban(args[2])
+		}) {
+			return fmt.Errorf("%w: %s", ErrNoRoom, room.Name)
+		}
+		if !unbanned {
+			return fmt.Errorf("%s isn't banned from room %s", args[2], room.Name)
+		}
+		fmt.Fprintln(out, "Unbanned", args[2], "from room", room.Name)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, see help", args[0])
+	}
+}
+
+// ListRooms writes every room with its players and bans
+func (s *Server) ListRooms(out io.Writer) {
+	s.mu.Lock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	s.mu.Unlock()
+	slices.SortFunc(rooms, func(a, b *Room) int { return strings.Compare(a.Name, b.Name) })
+
+	// rooms closed in the meantime are left out
+	for _, room := range rooms {
+		room.Do(func() {
+			fmt.Fprintf(out, "Room %s, %d players, locked %v\n", room.Name, len(room.players), room.locked)
+			for id := int32(0); id <= room.lastId; id++ {
+				player, ok := room.players[id]
+				if !ok {
+					continue
+				}
+				status := "offline"
+				if client := room.clients[id]; client != nil {
+					status = "online"
+					// known once it answered a heartbeat
+					if client.RoundTrip > 0 {
+						status = fmt.Sprint("online, round trip ", client.RoundTrip.Round(time.Millisecond))
+					}
+				}
+				fmt.Fprintf(out, "  %d %q %s %s from %s, %d scribbles\n", player.Id, player.Name, player.Role, status, player.Address, len(player.Scribbles))
+			}
+			for _, client := range room.clients {
+				if client.Spectator {
+					fmt.Fprintf(out, "  %d %q spectator from %s\n", client.Id, client.Name, client.Address)
+				}
+			}
+			for address := range room.bannedAddresses {
+				fmt.Fprintln(out, "  banned address", address)
+			}
+			for token := range room.bannedTokens {
+				fmt.Fprintln(out, "  banned token", token)
+			}
+		})
+	}
+}
+
+// lookup returns an open room, unlike Room it never creates one
+func (s *Server) lookup(name string) (*Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, ok := s.rooms[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoRoom, name)
+	}
+	return room, nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"main/common"
+)
+
+// evicted is the code the server closed the connection with
+func evicted(t *testing.T, events []*common.Event) common.ErrorCode {
+	t.Helper()
+	for _, event := range events {
+		if refusal, ok := event.InnerEvent.(common.ErrorEvent); ok {
+			return refusal.Code
+		}
+	}
+	t.Fatalf("got %v, want an error", kinds(events))
+	return 0
+}
+
+func isError(event *common.Event) bool {
+	_, ok := event.InnerEvent.(common.ErrorEvent)
+	return ok
+}
+
+func TestKickBanAddressAndPurge(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	s, addr := serve(t, config)
+
+	owner, ownerId, err := join(addr, common.PingEvent{Name: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	vandal, vandalId, err := join(addr, common.PingEvent{Name: "vandal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vandal.Close()
+	err = send(vandal, vandalId,
+		common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 1}},
+		common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 1, Pixels: []*common.Pixel{pixel(1, 1)}}},
+		common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitFor(owner, doneBy(vandalId)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = send(owner, ownerId, common.Event{Kind: "kick", InnerEvent: common.KickEvent{Id: vandalId, Reason: "vandalism", Ban: common.BanAddress, Purge: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := collect(vandal, isError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := evicted(t, events); code != common.Banned {
+		t.Errorf("kicked with code %d, want %d", code, common.Banned)
+	}
+	err = waitFor(owner, func(event *common.Event) bool {
+		_, purge := event.InnerEvent.(common.PurgeEvent)
+		return purge && event.PlayerId == vandalId
+	})
+	if err != nil {
+		t.Fatalf("no purge of the vandal's drawings: %v", err)
+	}
+
+	// every test client comes from the same address
+	code, err := refused(addr, common.PingEvent{Name: "vandal again"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != common.Banned {
+		t.Errorf("banned address refused with code %d, want %d", code, common.Banned)
+	}
+
+	room, err := s.lookup(common.DefaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.Do(func() {
+		if len(room.players[vandalId].Scribbles) != 0 {
+			t.Error("vandal's drawings still on the board")
+		}
+	})
+}
+
+func TestKickBanTokenFromConsole(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	s, addr := serve(t, config)
+
+	owner, _, err := join(addr, common.PingEvent{Name: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	vandal, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vandal.Close()
+	pong, err := answer(vandal, common.PingEvent{Name: "vandal", Capabilities: common.CapabilityResume})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumable, ok := pong.InnerEvent.(common.PongEvent)
+	if !ok || resumable.ResumeToken == "" {
+		t.Fatalf("got %s without a resume token", pong.Kind)
+	}
+	token := resumable.ResumeToken
+
+	var out strings.Builder
+	err = s.Command([]string{"kick", "-ban", "token", common.DefaultRoom, strconv.Itoa(int(pong.PlayerId)), "go", "away"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Kicked player") {
+		t.Errorf("console said %q", out.String())
+	}
+	events, err := collect(vandal, isError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := evicted(t, events); code != common.Banned {
+		t.Errorf("kicked with code %d, want %d", code, common.Banned)
+	}
+
+	code, err := refused(addr, common.PingEvent{Name: "vandal", Capabilities: common.CapabilityResume, ResumeToken: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != common.Banned {
+		t.Errorf("banned token refused with code %d, want %d", code, common.Banned)
+	}
+
+	if err := s.Command([]string{"kick", common.DefaultRoom, "42"}, &out); !errors.Is(err, ErrNoPlayer) {
+		t.Errorf("kicking nobody: got %v, want %v", err, ErrNoPlayer)
+	}
+	if err := s.Command([]string{"kick", "nowhere", "0"}, &out); !errors.Is(err, ErrNoRoom) {
+		t.Errorf("kicking in no room: got %v, want %v", err, ErrNoRoom)
+	}
+}
+
+func TestListRoundTrip(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	s, addr := serve(t, config)
+
+	conn, id, err := join(addr, common.PingEvent{Name: "painter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the heartbeat echoed back late, the stroke tells when it was handled
+	err = send(conn, id,
+		common.Event{Kind: "heartbeat", InnerEvent: common.HeartbeatEvent{SentAt: time.Now().Add(-time.Second).UnixNano()}},
+		common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 1}},
+		common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitFor(conn, doneBy(id)); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := s.Command([]string{"rooms"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"painter" owner online, round trip 1`) {
+		t.Errorf("console said %q, want the painter's round trip", out.String())
+	}
+}
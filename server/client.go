@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	"main/common"
+)
+
+// how long an evicted client gets to receive the reason before the connection is closed
+const evictWriteTimeout = time.Second
+
+// Player is what stays on the board after its connection is gone
+type Player struct {
+	Id        int32
+	Name      string
+	Token     string // lets a new connection take this player back
+	Role      common.Role
+	Address   string // host it last connected from, for bans
+	Drawing   bool
+	Stroke    uint32 // the stroke being drawn, chunks of other strokes are dropped
+	Scribbles [][]*common.Pixel
+	Deleted   [][]*common.Pixel
+}
+
+func NewPlayer(id int32, name string, role common.Role) *Player {
+	return &Player{
+		Id:        id,
+		Name:      name,
+		Role:      role,
+		Drawing:   false,
+		Scribbles: make([][]*common.Pixel, 0),
+		Deleted:   make([][]*common.Pixel, 0),
+	}
+}
+
+func NewToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// Client is a live connection playing as Player
+type Client struct {
+	*Player
+	Capabilities common.Capabilities
+	Conn         net.Conn
+	RoundTrip    time.Duration // measured from the heartbeat echoes
+	Spectator    bool          // read-only, its drawing events are ignored
+
+	outbound  chan []byte
+	evicted   chan struct{}
+	evictOnce sync.Once
+	reason    common.ErrorEvent
+}
+
+func NewClient(player *Player, capabilities common.Capabilities, conn net.Conn, queueLimit int) *Client {
+	return &Client{
+		Player:       player,
+		Capabilities: capabilities,
+		Conn:         conn,
+		outbound:     make(chan []byte, queueLimit),
+		evicted:      make(chan struct{}),
+	}
+}
+
+// Queue hands a frame to the writer without blocking,
+// it returns false when the queue is full
+func (c *Client) Queue(frame []byte) bool {
+	select {
+	case c.outbound <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// Evict stops the writer, which sends the reason and closes the connection,
+// a zero code closes it without a reason
+func (c *Client) Evict(code common.ErrorCode, message string) {
+	c.evictOnce.Do(func() {
+		c.reason = common.ErrorEvent{Code: code, Message: message}
+		close(c.evicted)
+	})
+}
+
+// Pick returns the compressed frame if there's one and the client supports it
+func (c *Client) Pick(frame []byte, compressed []byte) []byte {
+	if compressed != nil && c.Capabilities.Has(common.CapabilityCompression) {
+		return compressed
+	}
+	return frame
+}
+
+func (c *Client) Evicted() bool {
+	select {
+	case <-c.evicted:
+		return true
+	default:
+		return false
+	}
+}
+
+// WriteLoop is the only goroutine writing to the client's connection
+func (c *Client) WriteLoop() {
+	defer c.Conn.Close()
+
+	for {
+		select {
+		case frame := <-c.outbound:
+			if _, err := c.Conn.Write(frame); err != nil {
+				serverLogger.Println("Failed to write to client", c.Id, err)
+				c.Evict(0, "")
+				return
+			}
+		case <-c.evicted:
+			if c.reason.Code != 0 {
+				c.Conn.SetWriteDeadline(time.Now().Add(evictWriteTimeout))
+				common.WriteFrame(c.Conn, common.Event{
+					PlayerId:   c.Id,
+					Kind:       "error",
+					InnerEvent: c.reason,
+				})
+			}
+			return
+		}
+	}
+}
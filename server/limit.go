@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"main/common"
+)
+
+// FloodPolicy is what happens to events a connection sends over its limits,
+// but for the start and end of strokes which are never discarded
+type FloodPolicy int
+
+const (
+	FloodDrop       FloodPolicy = iota // discard them
+	FloodCoalesce                      // keep only the newest pixel, discard the rest
+	FloodDisconnect                    // tell the client why and close the connection
+)
+
+var floodPolicies = map[FloodPolicy]string{
+	FloodDrop:       "drop",
+	FloodCoalesce:   "coalesce",
+	FloodDisconnect: "disconnect",
+}
+
+func (p FloodPolicy) String() string {
+	return floodPolicies[p]
+}
+
+func (p FloodPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *FloodPolicy) UnmarshalText(text []byte) error {
+	for policy, name := range floodPolicies {
+		if name == string(text) {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown flood policy %q, want drop, coalesce or disconnect", text)
+}
+
+// Bucket is a token bucket refilled at rate tokens per second up to burst,
+// a zero rate never runs out
+type Bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate float64, burst float64) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Limiter holds the buckets of a single connection, it's only used
+// by that connection's ReadConn so it needs no locking
+type Limiter struct {
+	events *Bucket
+	bytes  *Bucket
+}
+
+// NewLimiter allows a second worth of events and bytes as burst,
+// and never less than a whole frame of bytes
+func NewLimiter(config Config) *Limiter {
+	return &Limiter{
+		events: NewBucket(config.EventRate, config.EventRate),
+		bytes:  NewBucket(config.ByteRate, max(config.ByteRate, float64(config.MaxFrame))),
+	}
+}
+
+// Allow takes one event of size bytes from the buckets,
+// nothing is taken unless both have enough left
+func (l *Limiter) Allow(size int) bool {
+	now := time.Now()
+	l.events.refill(now)
+	l.bytes.refill(now)
+	if l.events.rate > 0 && l.events.tokens < 1 {
+		return false
+	}
+	if l.bytes.rate > 0 && l.bytes.tokens < float64(size) {
+		return false
+	}
+	l.Take(size)
+	return true
+}
+
+// Take takes one event of size bytes from the buckets even if they don't
+// have enough left, the debt is paid back before anything else is allowed
+func (l *Limiter) Take(size int) {
+	l.events.tokens--
+	l.bytes.tokens -= float64(size)
+}
+
+// boundary tells whether an event starts or ends a stroke, the policies
+// charge those but never discard them
+func boundary(event *common.Event) bool {
+	switch event.InnerEvent.(type) {
+	case common.StartedEvent, common.DoneEvent:
+		return true
+	default:
+		return false
+	}
+}
+
+// limited tells whether an event goes through the limiter, the handshake,
+// heartbeats and leaving limit themselves and must never be dropped
+func limited(event *common.Event) bool {
+	switch event.InnerEvent.(type) {
+	case common.PingEvent, common.HeartbeatEvent, common.LeftEvent:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"main/common"
+)
+
+func TestLimiter(t *testing.T) {
+	config := DefaultConfig()
+	config.EventRate = 2
+	config.ByteRate = 0
+	limiter := NewLimiter(config)
+
+	if !limiter.Allow(100) || !limiter.Allow(100) {
+		t.Fatal("burst of a second worth of events refused")
+	}
+	if limiter.Allow(100) {
+		t.Fatal("event over the burst allowed")
+	}
+	// half a second later one event is back
+	limiter.events.last = limiter.events.last.Add(-500 * time.Millisecond)
+	if !limiter.Allow(100) {
+		t.Error("event refused after the bucket refilled")
+	}
+
+	// taken events are a debt paid before anything is allowed again
+	limiter.Take(100)
+	limiter.events.last = limiter.events.last.Add(-500 * time.Millisecond)
+	if limiter.Allow(100) {
+		t.Error("event allowed while the bucket is in debt")
+	}
+}
+
+func TestLimiterBytes(t *testing.T) {
+	config := DefaultConfig()
+	config.EventRate = 0
+	config.ByteRate = 100
+	config.MaxFrame = 50
+	limiter := NewLimiter(config)
+
+	if !limiter.Allow(60) {
+		t.Fatal("frame within the burst refused")
+	}
+	if limiter.Allow(60) {
+		t.Error("frame over the byte budget allowed")
+	}
+	if !limiter.Allow(40) {
+		t.Error("frame fitting the rest of the budget refused")
+	}
+}
+
+// flood sends a stroke of n chunks of one pixel each, as fast as it can
+func flood(conn net.Conn, id int32, n int) error {
+	for i := range n + 2 {
+		event := common.Event{PlayerId: id, Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 1, Pixels: []*common.Pixel{pixel(float32(i), 1)}}}
+		switch i {
+		case 0:
+			event.Kind, event.InnerEvent = "started", common.StartedEvent{Stroke: 1}
+		case n + 1:
+			event.Kind, event.InnerEvent = "done", common.DoneEvent{}
+		}
+		if err := common.WriteFrame(conn, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFloodPolicies(t *testing.T) {
+	const chunks = 50
+	for _, policy := range []FloodPolicy{FloodDrop, FloodCoalesce} {
+		t.Run(policy.String(), func(t *testing.T) {
+			config := DefaultConfig()
+			config.HeartbeatInterval = 0
+			config.EventRate = 5
+			config.Flood = policy
+			s, addr := serve(t, config)
+
+			conn, id, err := join(addr, common.PingEvent{Name: "flooder"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// the start and the end are over the limits as well
+			if err := flood(conn, id, chunks); err != nil {
+				t.Fatal(err)
+			}
+			if err := waitFor(conn, doneBy(id)); err != nil {
+				t.Fatalf("the end of the stroke was lost: %v", err)
+			}
+
+			room, err := s.lookup(common.DefaultRoom)
+			if err != nil {
+				t.Fatal(err)
+			}
+			room.Do(func() {
+				player := room.players[id]
+				if player.Drawing || len(player.Scribbles) != 1 {
+					t.Fatalf("drawing %v with %d scribbles, want the stroke over", player.Drawing, len(player.Scribbles))
+				}
+				pixels := player.Scribbles[0]
+				if len(pixels) == 0 || len(pixels) >= chunks {
+					t.Errorf("%d of %d pixels got through", len(pixels), chunks)
+				}
+			})
+			if s.dropped.Load()+s.coalesced.Load() == 0 {
+				t.Error("nothing counted over the limits")
+			}
+		})
+	}
+}
+
+func TestFloodCoalesceFlushesWhenQuiet(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	config.EventRate = 5
+	config.Flood = FloodCoalesce
+	_, addr := serve(t, config)
+
+	conn, id, err := join(addr, common.PingEvent{Name: "flooder"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = send(conn, id, common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 20 {
+		err := send(conn, id, common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 1, Pixels: []*common.Pixel{pixel(float32(i), 1)}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// no done follows, the newest pixel still has to show up
+	err = waitFor(conn, func(event *common.Event) bool {
+		chunk, ok := event.InnerEvent.(common.StrokeChunkEvent)
+		return ok && len(chunk.Pixels) > 0 && common.Last(chunk.Pixels).Center.X == 19
+	})
+	if err != nil {
+		t.Fatalf("the newest pixel of the flood never came: %v", err)
+	}
+}
+
+func TestFloodDisconnect(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	config.EventRate = 5
+	config.Flood = FloodDisconnect
+	_, addr := serve(t, config)
+
+	conn, id, err := join(addr, common.PingEvent{Name: "flooder"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := flood(conn, id, 50); err != nil {
+		t.Fatal(err)
+	}
+	events, err := collect(conn, isError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := evicted(t, events); code != common.RateLimited {
+		t.Errorf("disconnected with code %d, want %d", code, common.RateLimited)
+	}
+}
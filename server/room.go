@@ -0,0 +1,750 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"main/common"
+)
+
+// Room is a board of its own with its players, history and tick, on a
+// server that can hold many. Its state is owned by its Run goroutine:
+// ReadConn only decodes frames and hands them over through received,
+// so players, clients, lastId and eventsToSend are never touched concurrently.
+type Room struct {
+	Name            string
+	Config          Config
+	server          *Server
+	lastId          int32
+	lastSpectator   int32                // spectators count down from -2, -1 is the server on rejections
+	locked          bool                 // only owners can draw
+	players         map[int32]*Player    // everyone who ever drew on the board
+	clients         map[int32]*Client    // live connections only
+	byConn          map[net.Conn]*Client // who is behind each live connection
+	sessions        map[string]int32     // resume token to player id
+	seq             uint64               // sequence number of the last broadcast
+	history         []SentFrame
+	bannedTokens    map[string]bool
+	bannedAddresses map[string]bool
+	commands        chan func() // run by Run for callers outside the room, see Do
+	store           *Store      // nil when the room is only kept in memory
+	received        chan Received
+	closed          chan net.Conn
+	flooded         chan net.Conn // connections over the limits with the disconnect policy
+	ready           chan struct{} // closed once the room is read from its store
+	err             error         // why the room couldn't be opened, set before ready is closed
+	done            chan struct{} // closed by Server.Release to stop Run
+	stopped         chan struct{} // closed once Run saved the room and let go of its name
+	conns           int           // connections holding the room, guarded by Server.mu
+	closing         bool          // done is closed, guarded by Server.mu
+	eventsToSend    []*common.Event
+}
+
+// SentFrame is a broadcast frame kept around for resuming clients
+type SentFrame struct {
+	Seq        uint64
+	Frame      []byte
+	Compressed []byte // nil when the frame is too small to bother
+}
+
+// Received is an event read from a connection, waiting to be handled by Run
+type Received struct {
+	Event *common.Event
+	Conn  net.Conn
+}
+
+func NewRoom(server *Server, name string) *Room {
+	return &Room{
+		Name:            name,
+		Config:          server.Config,
+		server:          server,
+		lastId:          -1,
+		lastSpectator:   -1,
+		players:         make(map[int32]*Player),
+		clients:         make(map[int32]*Client),
+		byConn:          make(map[net.Conn]*Client),
+		sessions:        make(map[string]int32),
+		history:         make([]SentFrame, 0),
+		bannedTokens:    make(map[string]bool),
+		bannedAddresses: make(map[string]bool),
+		commands:        make(chan func()),
+		received:        make(chan Received),
+		closed:          make(chan net.Conn),
+		flooded:         make(chan net.Conn),
+		ready:           make(chan struct{}),
+		done:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+		eventsToSend:    make([]*common.Event, 0),
+	}
+}
+
+// Run is the only goroutine allowed to touch the room state, it handles
+// received events as they arrive and flushes the queued ones every tick
+func (r *Room) Run() {
+	ticker := time.NewTicker(time.Second / 60)
+	defer ticker.Stop()
+	var heartbeat <-chan time.Time
+	if r.Config.HeartbeatInterval > 0 {
+		heartbeatTicker := time.NewTicker(r.Config.HeartbeatInterval)
+		defer heartbeatTicker.Stop()
+		heartbeat = heartbeatTicker.C
+	}
+	var snapshot <-chan time.Time
+	if r.store != nil && r.Config.SnapshotInterval > 0 {
+		snapshotTicker := time.NewTicker(r.Config.SnapshotInterval)
+		defer snapshotTicker.Stop()
+		snapshot = snapshotTicker.C
+	}
+
+	for {
+		select {
+		case received := <-r.received:
+			r.SHandleReceivedEvents(received.Event, received.Conn)
+		case conn := <-r.closed:
+			if client, ok := r.byConn[conn]; ok {
+				serverLogger.Println("Connection lost", client.Id)
+				r.Disconnect(client)
+			}
+		case conn := <-r.flooded:
+			client, ok := r.byConn[conn]
+			if !ok {
+				// flooding before the handshake, there's no writer to tell it why
+				conn.Close()
+				continue
+			}
+			client.Evict(common.RateLimited, "too many events, slow down")
+			r.Disconnect(client)
+		case <-ticker.C:
+			r.SendEvent()
+		case <-heartbeat:
+			r.Heartbeat()
+		case command := <-r.commands:
+			command()
+		case <-snapshot:
+			r.SaveSnapshot()
+		case <-r.done:
+			r.Close()
+			return
+		}
+	}
+}
+
+// Close saves the room one last time and lets a new room take its name,
+// Run calls it once the last connection is gone
+func (r *Room) Close() {
+	defer close(r.stopped)
+	r.SaveSnapshot()
+	if r.store != nil {
+		if err := r.store.Close(); err != nil {
+			serverLogger.Println("Failed to close the log of room", r.Name, err)
+		}
+	}
+	r.server.mu.Lock()
+	delete(r.server.rooms, r.Name)
+	r.server.mu.Unlock()
+}
+
+// Do runs f on the Run goroutine and waits for it to return,
+// f can then use the room state like the event handlers do.
+// It's false when the room was closed and f never ran
+func (r *Room) Do(f func()) bool {
+	done := make(chan struct{})
+	select {
+	case r.commands <- func() {
+		defer close(done)
+		f()
+	}:
+	case <-r.done:
+		return false
+	}
+	<-done
+	return true
+}
+
+// Heartbeat sends every client the time, which it echoes back
+// so we can measure its round trip
+func (r *Room) Heartbeat() {
+	now := time.Now().UnixNano()
+	for _, client := range r.clients {
+		r.SendTo(client, &common.Event{
+			PlayerId: client.Id,
+			Kind:     "heartbeat",
+			InnerEvent: common.HeartbeatEvent{
+				SentAt:    now,
+				RoundTrip: int64(client.RoundTrip),
+			},
+		})
+	}
+}
+
+func (r *Room) SHandleReceivedEvents(event *common.Event, conn net.Conn) {
+	// stay aware that when just forwarding the events to be sent it may break things
+	// the player id is bound to the connection by the handshake,
+	// the one on the wire is only checked against it
+	sender, bound := r.byConn[conn]
+	switch event.InnerEvent.(type) {
+	case common.PingEvent:
+		if bound {
+			serverLogger.Println("Receiving: Second handshake from player", sender.Id, "ignored")
+			return
+		}
+	default:
+		if !bound {
+			serverLogger.Println("Receiving: Event before handshake from", conn.RemoteAddr(), "ignored")
+			return
+		}
+		if event.PlayerId != sender.Id {
+			serverLogger.Println("Receiving: Player", sender.Id, "at", conn.RemoteAddr(), "sent an event as player", event.PlayerId, "ignored")
+			return
+		}
+		if !r.allowed(sender, event) {
+			serverLogger.Println("Receiving: Player", sender.Id, "as", sender.Role, "sent", event.Kind, "ignored")
+			return
+		}
+	}
+
+	switch innerEvent := event.InnerEvent.(type) {
+	case common.PingEvent:
+		serverLogger.Println("Receiving: Ping received from", innerEvent.Name)
+
+		capabilities := innerEvent.Capabilities & common.SupportedCapabilities
+		if r.Config.Compress <= 0 {
+			capabilities &^= common.CapabilityCompression
+		}
+		if r.bannedAddresses[remoteHost(conn)] || r.bannedTokens[innerEvent.ResumeToken] {
+			serverLogger.Println("Rejecting banned", conn.RemoteAddr(), "from room", r.Name)
+			go Reject(conn, common.Banned, "banned from this room")
+			return
+		}
+
+		// whatever is still queued is already part of the board, so it has
+		// to go out before the client is added or it would get it twice
+		r.SendEvent()
+
+		if playerId, ok := r.sessions[innerEvent.ResumeToken]; ok && capabilities.Has(common.CapabilityResume) && !innerEvent.Spectator {
+			r.Resume(r.players[playerId], innerEvent.LastSeq, capabilities, conn)
+			return
+		}
+
+		// a resume token is proof enough, newcomers need the password or an invite
+		if !r.server.Admit(innerEvent.Password) {
+			serverLogger.Println("Rejecting", conn.RemoteAddr(), "with a wrong password")
+			go Reject(conn, common.Unauthorized, "wrong password or invite")
+			return
+		}
+
+		if innerEvent.Spectator {
+			r.Spectate(innerEvent.Name, capabilities, conn)
+			return
+		}
+
+		r.lastId++
+		newId := r.lastId
+		role := common.RoleEditor
+		if newId == 0 {
+			role = common.RoleOwner
+		}
+		player := NewPlayer(newId, innerEvent.Name, role)
+		player.Address = remoteHost(conn)
+		if capabilities.Has(common.CapabilityResume) {
+			player.Token = NewToken()
+			r.sessions[player.Token] = newId
+		}
+		r.LogPlayer(player)
+		client := NewClient(player, capabilities, conn, r.Config.QueueLimit)
+		r.players[newId] = player
+		r.clients[newId] = client
+		r.byConn[conn] = client
+		go client.WriteLoop()
+		r.Pong(client, false)
+		r.Snapshot(client)
+		r.Joined(player)
+	case common.HeartbeatEvent:
+		sender.RoundTrip = time.Since(time.Unix(0, innerEvent.SentAt))
+		serverLogger.Println("Receiving: Heartbeat", sender.Id, "round trip", sender.RoundTrip)
+	case common.LeftEvent:
+		serverLogger.Println("Receiving: Left")
+		r.Disconnect(sender)
+	case common.StartedEvent:
+		serverLogger.Println("Receiving: Started Drawing")
+		sender.Drawing = true
+		sender.Stroke = innerEvent.Stroke
+		common.Append(&sender.Scribbles, []*common.Pixel{})
+		r.Enqueue(&common.Event{
+			PlayerId:   event.PlayerId,
+			Kind:       event.Kind,
+			InnerEvent: innerEvent,
+		})
+	case common.DoneEvent:
+		serverLogger.Println("Receiving: Done")
+		r.StopDrawing(sender.Player)
+	case common.StrokeChunkEvent:
+		serverLogger.Println("Receiving: Player sending pixels")
+		// the StartedEvent of that stroke was dropped, or it's long over
+		if !sender.Drawing || innerEvent.Stroke != sender.Stroke {
+			serverLogger.Println("Receiving: Player", sender.Id, "sent a chunk of stroke", innerEvent.Stroke, "while on", sender.Stroke, "ignored")
+			return
+		}
+		for _, pixel := range innerEvent.Pixels {
+			if err := pixel.Validate(); err != nil {
+				serverLogger.Println("Receiving: Player", sender.Id, "sent", err, "ignored")
+				return
+			}
+		}
+		maxIndex := len(sender.Scribbles) - 1
+		if maxIndex >= 0 {
+			sender.Scribbles[maxIndex] = append(sender.Scribbles[maxIndex], innerEvent.Pixels...)
+		}
+		r.EnqueueChunk(event)
+	case common.UndoEvent:
+		serverLogger.Println("Receiving: Player sending undo")
+		maxIndex := len(sender.Scribbles) - 1
+		if maxIndex >= 0 {
+			last := sender.Scribbles[maxIndex]
+			sender.Scribbles = sender.Scribbles[:maxIndex]
+			common.Append(&sender.Deleted, last)
+			r.Enqueue(event)
+		}
+	case common.RedoEvent:
+		serverLogger.Println("Receiving: Player sending redo")
+		maxIndex := len(sender.Deleted) - 1
+		if maxIndex >= 0 {
+			last := sender.Deleted[maxIndex]
+			common.Append(&sender.Scribbles, last)
+			sender.Deleted = sender.Deleted[:maxIndex]
+			r.Enqueue(&common.Event{
+				PlayerId: event.PlayerId,
+				Kind:     "redo",
+				InnerEvent: common.RedoEvent{
+					Pixels: last,
+				},
+			})
+		}
+	case common.RoleEvent:
+		serverLogger.Println("Receiving: Player", sender.Id, "gives player", innerEvent.Id, "the role", innerEvent.Role)
+		target, ok := r.players[innerEvent.Id]
+		if !ok || target == sender.Player || innerEvent.Role < common.RoleViewer || innerEvent.Role > common.RoleOwner {
+			return
+		}
+		target.Role = innerEvent.Role
+		if !target.Role.CanDraw(r.locked) {
+			r.StopDrawing(target)
+		}
+		r.Enqueue(event)
+	case common.LockEvent:
+		serverLogger.Println("Receiving: Player", sender.Id, "locks the board", innerEvent.Locked)
+		if innerEvent.Locked == r.locked {
+			return
+		}
+		r.locked = innerEvent.Locked
+		for _, player := range r.players {
+			if !player.Role.CanDraw(r.locked) {
+				r.StopDrawing(player)
+			}
+		}
+		r.Enqueue(event)
+	case common.ClearEvent:
+		serverLogger.Println("Receiving: Player", sender.Id, "clears the board")
+		for _, player := range r.players {
+			r.StopDrawing(player)
+			player.Scribbles = make([][]*common.Pixel, 0)
+			player.Deleted = make([][]*common.Pixel, 0)
+		}
+		r.Enqueue(event)
+	case common.KickEvent:
+		serverLogger.Println("Receiving: Player", sender.Id, "kicks player", innerEvent.Id)
+		if innerEvent.Id == sender.Id {
+			return
+		}
+		reason := innerEvent.Reason
+		if reason == "" {
+			reason = "kicked by the owner"
+		}
+		if err := r.Kick(innerEvent.Id, reason, innerEvent.Ban, innerEvent.Purge); err != nil {
+			serverLogger.Println("Receiving: Kick of player", innerEvent.Id, "failed:", err)
+		}
+	default:
+		serverLogger.Println("Receiving: Unknown event type")
+	}
+}
+
+// Kick closes the connection of player id with the reason, if it's online.
+// A ban keeps the player out of the room, see common.Ban, and purging
+// removes its drawings from the board.
+func (r *Room) Kick(id int32, reason string, ban common.Ban, purge bool) error {
+	client, online := r.clients[id]
+	player, ok := r.players[id]
+	if online {
+		player = client.Player
+	} else if !ok {
+		return ErrNoPlayer
+	}
+
+	r.Ban(player, ban)
+	serverLogger.Println("Kicking", id, "from room", r.Name, "ban", ban, "purge", purge, reason)
+
+	if online {
+		code := common.Kicked
+		if ban != common.BanNone {
+			code = common.Banned
+		}
+		client.Evict(code, reason)
+		r.Disconnect(client)
+	}
+	// spectators have nothing to purge
+	if purge && ok {
+		r.Purge(player)
+	}
+	return nil
+}
+
+// Ban keeps the player out of the room, see common.Ban
+func (r *Room) Ban(player *Player, ban common.Ban) {
+	if ban != common.BanNone && player.Token != "" {
+		r.bannedTokens[player.Token] = true
+		delete(r.sessions, player.Token)
+		r.Append(recordBannedToken, []byte(player.Token))
+	}
+	if ban == common.BanAddress && player.Address != "" {
+		r.bannedAddresses[player.Address] = true
+		r.Append(recordBannedAddress, []byte(player.Address))
+	}
+}
+
+// Unban lets a banned address or token back in, it returns false if it wasn't banned
+func (r *Room) Unban(ban string) bool {
+	banned := r.bannedAddresses[ban] || r.bannedTokens[ban]
+	delete(r.bannedAddresses, ban)
+	delete(r.bannedTokens, ban)
+	if banned {
+		r.Append(recordUnban, []byte(ban))
+	}
+	return banned
+}
+
+// Purge removes every drawing of the player from the board
+func (r *Room) Purge(player *Player) {
+	r.StopDrawing(player)
+	player.Scribbles = make([][]*common.Pixel, 0)
+	player.Deleted = make([][]*common.Pixel, 0)
+	r.Enqueue(&common.Event{
+		PlayerId:   player.Id,
+		Kind:       "purge",
+		InnerEvent: common.PurgeEvent{},
+	})
+}
+
+// remoteHost is the address of the peer without its port, what bans are about
+func remoteHost(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// allowed tells whether the role of the sender lets it send the event,
+// spectators are viewers
+func (r *Room) allowed(sender *Client, event *common.Event) bool {
+	switch event.InnerEvent.(type) {
+	case common.StartedEvent, common.StrokeChunkEvent:
+		return sender.Role.CanDraw(r.locked)
+	case common.UndoEvent, common.RedoEvent:
+		// the chunks still coming would end up in another scribble
+		return sender.Role.CanDraw(r.locked) && !sender.Drawing
+	case common.RoleEvent, common.LockEvent, common.ClearEvent, common.KickEvent:
+		return sender.Role == common.RoleOwner
+	default:
+		return true
+	}
+}
+
+// StopDrawing ends the stroke of the player for everyone,
+// chunks of that stroke arriving later are dropped
+func (r *Room) StopDrawing(player *Player) {
+	if !player.Drawing {
+		return
+	}
+	player.Drawing = false
+	r.Enqueue(&common.Event{
+		PlayerId:   player.Id,
+		Kind:       "done",
+		InnerEvent: common.DoneEvent{},
+	})
+}
+
+// Resume attaches a new connection to an existing player and replays the
+// broadcasts it missed, if they are still in the history
+func (r *Room) Resume(player *Player, lastSeq uint64, capabilities common.Capabilities, conn net.Conn) {
+	serverLogger.Println("Resuming player", player.Id, "from", lastSeq)
+
+	// the old connection is probably half-open, drop it without telling anyone
+	old, replaced := r.clients[player.Id]
+	if replaced {
+		delete(r.clients, player.Id)
+		delete(r.byConn, old.Conn)
+		old.Evict(0, "")
+	}
+
+	player.Address = remoteHost(conn)
+	client := NewClient(player, capabilities, conn, r.Config.QueueLimit)
+	r.clients[player.Id] = client
+	r.byConn[conn] = client
+	go client.WriteLoop()
+
+	missed, ok := r.Missed(lastSeq)
+	r.Pong(client, ok)
+	if !ok {
+		r.Snapshot(client)
+	}
+	for _, sent := range missed {
+		r.Send(client, client.Pick(sent.Frame, sent.Compressed))
+	}
+	// everyone else saw it leave, unless the old connection was still around
+	if !replaced {
+		r.Joined(player)
+	}
+}
+
+// Spectate adds a read-only client, it isn't a player of the board so
+// nobody is told about it and there's no session to resume
+func (r *Room) Spectate(name string, capabilities common.Capabilities, conn net.Conn) {
+	r.lastSpectator--
+	serverLogger.Println("Spectator", r.lastSpectator, name, "watching room", r.Name)
+	capabilities &^= common.CapabilityResume
+	client := NewClient(NewPlayer(r.lastSpectator, name, common.RoleViewer), capabilities, conn, r.Config.QueueLimit)
+	client.Spectator = true
+	client.Address = remoteHost(conn)
+	r.clients[client.Id] = client
+	r.byConn[conn] = client
+	go client.WriteLoop()
+	r.Pong(client, false)
+	r.Snapshot(client)
+}
+
+func (r *Room) Pong(client *Client, resumed bool) {
+	r.SendTo(client, &common.Event{
+		PlayerId: client.Id,
+		Kind:     "pong",
+		InnerEvent: common.PongEvent{
+			Version:           common.ProtocolVersion,
+			Capabilities:      client.Capabilities,
+			ResumeToken:       client.Token,
+			Resumed:           resumed,
+			HeartbeatInterval: uint32(r.Config.HeartbeatInterval.Milliseconds()),
+			HeartbeatMisses:   uint8(r.Config.HeartbeatMisses),
+		},
+	})
+}
+
+// Snapshot sends the whole board to a client that has none, numbered
+// with the last broadcast so the client can resume from there
+func (r *Room) Snapshot(client *Client) {
+	snapshot := common.SnapshotEvent{Locked: r.locked, Players: make([]common.PlayerState, 0, len(r.players))}
+	for id := int32(0); id <= r.lastId; id++ {
+		player, ok := r.players[id]
+		if !ok {
+			continue
+		}
+		common.Append(&snapshot.Players, common.PlayerState{
+			Id:        player.Id,
+			Name:      player.Name,
+			Role:      player.Role,
+			Online:    r.clients[player.Id] != nil,
+			Drawing:   player.Drawing,
+			Scribbles: player.Scribbles,
+		})
+	}
+
+	serverLogger.Println("Sending: Snapshot to", client.Id, "with", len(snapshot.Players), "players")
+	r.SendTo(client, &common.Event{
+		Seq:        r.seq,
+		PlayerId:   client.Id,
+		Kind:       "snapshot",
+		InnerEvent: snapshot,
+	})
+}
+
+// Joined tells everyone a player is on the board
+func (r *Room) Joined(player *Player) {
+	r.Enqueue(&common.Event{
+		PlayerId: player.Id,
+		Kind:     "player joined",
+		InnerEvent: common.PlayerJoinedEvent{
+			Id:   player.Id,
+			Name: player.Name,
+			Role: player.Role,
+		},
+	})
+}
+
+// Missed returns the broadcasts after lastSeq, ok is false
+// when some of them already fell out of the history
+func (r *Room) Missed(lastSeq uint64) (missed []SentFrame, ok bool) {
+	if lastSeq > r.seq {
+		return nil, false
+	}
+	if lastSeq == r.seq {
+		return nil, true
+	}
+	if len(r.history) == 0 || r.history[0].Seq > lastSeq+1 {
+		return nil, false
+	}
+	start := lastSeq + 1 - r.history[0].Seq
+	return r.history[start:], true
+}
+
+// Disconnect forgets the connection and tells everyone the player left,
+// the player's drawings stay on the board
+func (r *Room) Disconnect(client *Client) {
+	delete(r.clients, client.Id)
+	delete(r.byConn, client.Conn)
+	// stops the writer, which closes the connection
+	client.Evict(0, "")
+	if client.Spectator {
+		return
+	}
+	// everyone else would keep its stroke as being drawn
+	r.StopDrawing(client.Player)
+	r.Enqueue(&common.Event{
+		PlayerId:   client.Id,
+		Kind:       "left",
+		InnerEvent: common.LeftEvent{},
+	})
+}
+
+// Enqueue queues an event to be sent on the next tick
+func (r *Room) Enqueue(event *common.Event) {
+	common.Append(&r.eventsToSend, event)
+}
+
+// EnqueueChunk merges the chunk into the one of the same stroke already
+// waiting for the tick, if it's the player's last queued event
+func (r *Room) EnqueueChunk(event *common.Event) {
+	for i := len(r.eventsToSend) - 1; i >= 0; i-- {
+		if r.eventsToSend[i].PlayerId != event.PlayerId {
+			continue
+		}
+		if common.MergeChunk(r.eventsToSend[i], event) {
+			return
+		}
+		break
+	}
+	r.Enqueue(event)
+}
+
+// SendEvent broadcasts every event accumulated since the last tick,
+// numbering them and keeping them in the history
+func (r *Room) SendEvent() {
+	events := r.eventsToSend
+	r.eventsToSend = make([]*common.Event, 0)
+
+	for _, event := range events {
+		r.seq++
+		event.Seq = r.seq
+		frame, err := common.EncodeFrame(*event)
+		if err != nil {
+			serverLogger.Println("Failed to encode event:", err)
+			continue
+		}
+		// logged before anyone sees it, the frame minus its length is the payload
+		r.Append(recordEvent, frame[4:])
+		compressed := r.Compress(frame)
+		r.Remember(SentFrame{Seq: event.Seq, Frame: frame, Compressed: compressed})
+
+		switch event.InnerEvent.(type) {
+		case common.PlayerJoinedEvent:
+			serverLogger.Println("Sending: PlayerJoinedEvent", event.PlayerId)
+			r.Broadcast(frame, compressed)
+		case common.LeftEvent:
+			serverLogger.Println("Sending: Left", event.PlayerId)
+			r.Broadcast(frame, compressed)
+		case common.StartedEvent:
+			serverLogger.Println("Sending: StartedEvent", event.PlayerId)
+			r.Broadcast(frame, compressed)
+		case common.DoneEvent:
+			serverLogger.Println("Sending: DoneEvent", event.PlayerId)
+			r.Broadcast(frame, compressed)
+		case common.StrokeChunkEvent:
+			serverLogger.Println("Sending: StrokeChunkEvent", event.PlayerId)
+			r.Broadcast(frame, compressed)
+		case common.UndoEvent:
+			serverLogger.Println("Sending: UndoEvent", event.PlayerId)
+			r.Broadcast(frame, compressed)
+		case common.RedoEvent:
+			serverLogger.Println("Sending: RedoEvent", event.PlayerId)
+			r.Broadcast(frame, compressed)
+		case common.RoleEvent:
+			serverLogger.Println("Sending: RoleEvent", event.PlayerId)
+			r.Broadcast(frame, compressed)
+		case common.LockEvent:
+			serverLogger.Println("Sending: LockEvent", event.PlayerId)
+			r.Broadcast(frame, compressed)
+		case common.ClearEvent:
+			serverLogger.Println("Sending: ClearEvent", event.PlayerId)
+			r.Broadcast(frame, compressed)
+		case common.PurgeEvent:
+			serverLogger.Println("Sending: PurgeEvent", event.PlayerId)
+			r.Broadcast(frame, compressed)
+		default:
+			serverLogger.Println("Sending: Unknown event type")
+		}
+	}
+}
+
+func (r *Room) Remember(sent SentFrame) {
+	common.Append(&r.history, sent)
+	if len(r.history) > r.Config.History {
+		r.history = r.history[len(r.history)-r.Config.History:]
+	}
+}
+
+// SendTo sends an event to a single client right away, outside of the tick
+func (r *Room) SendTo(client *Client, event *common.Event) {
+	frame, err := common.EncodeFrame(*event)
+	if err != nil {
+		serverLogger.Println("Failed to encode event:", err)
+		return
+	}
+	if client.Capabilities.Has(common.CapabilityCompression) {
+		frame = client.Pick(frame, r.Compress(frame))
+	}
+	r.Send(client, frame)
+}
+
+// Broadcast sends the compressed frame, if any, to the clients supporting it
+func (r *Room) Broadcast(frame []byte, compressed []byte) {
+	for _, client := range r.clients {
+		r.Send(client, client.Pick(frame, compressed))
+	}
+}
+
+// Compress returns the compressed copy of frames above the threshold,
+// nil when the frame is small or doesn't shrink
+func (r *Room) Compress(frame []byte) []byte {
+	if r.Config.Compress <= 0 || len(frame) < r.Config.Compress {
+		return nil
+	}
+	compressed, err := common.CompressFrame(frame)
+	if err != nil {
+		serverLogger.Println("Failed to compress frame:", err)
+		return nil
+	}
+	if len(compressed) >= len(frame) {
+		return nil
+	}
+	return compressed
+}
+
+// Send queues a frame for the client's writer, a client whose queue
+// is full is evicted instead of stalling everyone else
+func (r *Room) Send(client *Client, frame []byte) {
+	if client.Evicted() {
+		return
+	}
+	if !client.Queue(frame) {
+		serverLogger.Println("Evicting slow client", client.Id)
+		client.Evict(common.SlowClient, "too slow, outbound queue is full")
+	}
+}
@@ -0,0 +1,474 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"main/common"
+)
+
+// doneBy matches the broadcast ending a stroke of that player
+func doneBy(id int32) func(*common.Event) bool {
+	return func(event *common.Event) bool {
+		_, done := event.InnerEvent.(common.DoneEvent)
+		return done && event.PlayerId == id
+	}
+}
+
+func TestEventsForOtherPlayersIgnored(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	s, addr := serve(t, config)
+
+	victim, victimId, err := join(addr, common.PingEvent{Name: "victim"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer victim.Close()
+	err = send(victim, victimId,
+		common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 1}},
+		common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 1, Pixels: []*common.Pixel{pixel(1, 1), pixel(2, 2)}}},
+		common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitFor(victim, doneBy(victimId)); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a handshake the connection is closed on its first event
+	stranger, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	if err := send(stranger, victimId, common.Event{Kind: "undo", InnerEvent: common.UndoEvent{}}); err != nil {
+		t.Fatal(err)
+	}
+	if event, err := readEvent(stranger); err == nil {
+		t.Errorf("got %s before the handshake, want the connection closed", event.Kind)
+	}
+
+	attacker, attackerId, err := join(addr, common.PingEvent{Name: "attacker"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+	if attackerId == victimId {
+		t.Fatalf("both players got id %d", victimId)
+	}
+	err = send(attacker, victimId,
+		common.Event{Kind: "undo", InnerEvent: common.UndoEvent{}},
+		common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 1}},
+		common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 1, Pixels: []*common.Pixel{pixel(3, 3)}}},
+		common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a stroke of its own, once it's back the spoofed events were handled
+	err = send(attacker, attackerId,
+		common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 1}},
+		common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitFor(attacker, doneBy(attackerId)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the other clients must not see the spoofed events either
+	err = waitFor(victim, func(event *common.Event) bool {
+		switch event.InnerEvent.(type) {
+		case common.UndoEvent, common.StartedEvent, common.StrokeChunkEvent, common.DoneEvent:
+			if event.PlayerId == victimId {
+				t.Errorf("%s of the attacker broadcast as the victim's", event.Kind)
+			}
+		}
+		return doneBy(attackerId)(event)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	room, err := s.lookup(common.DefaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.Do(func() {
+		// a connection the room never saw a handshake from
+		unbound, _ := net.Pipe()
+		defer unbound.Close()
+		room.SHandleReceivedEvents(&common.Event{PlayerId: victimId, Kind: "undo", InnerEvent: common.UndoEvent{}}, unbound)
+
+		player := room.players[victimId]
+		if len(player.Scribbles) != 1 || len(player.Scribbles[0]) != 2 {
+			t.Errorf("victim has scribbles %v, want its own stroke of 2 pixels", player.Scribbles)
+		}
+		if len(player.Deleted) != 0 {
+			t.Errorf("victim has %d deleted scribbles, want none", len(player.Deleted))
+		}
+		if player.Drawing {
+			t.Error("victim is drawing")
+		}
+	})
+}
+
+// collect reads the broadcasts up to the first one that matches, included
+func collect(conn net.Conn, match func(*common.Event) bool) ([]*common.Event, error) {
+	var events []*common.Event
+	err := waitFor(conn, func(event *common.Event) bool {
+		events = append(events, event)
+		return match(event)
+	})
+	return events, err
+}
+
+// kinds lists what was broadcast, for the error messages
+func kinds(events []*common.Event) []string {
+	names := make([]string, 0, len(events))
+	for _, event := range events {
+		names = append(names, event.Kind)
+	}
+	return names
+}
+
+func TestOwnerModeration(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	s, addr := serve(t, config)
+
+	owner, ownerId, err := join(addr, common.PingEvent{Name: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	editor, editorId, err := join(addr, common.PingEvent{Name: "editor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer editor.Close()
+
+	moderation := []common.Event{
+		{Kind: "lock", InnerEvent: common.LockEvent{Locked: true}},
+		{Kind: "role", InnerEvent: common.RoleEvent{Id: ownerId, Role: common.RoleViewer}},
+		{Kind: "clear", InnerEvent: common.ClearEvent{}},
+	}
+	// the editor's stroke comes back after its moderation events were handled
+	err = send(editor, editorId, append(moderation,
+		common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 1}},
+		common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 1, Pixels: []*common.Pixel{pixel(1, 1)}}},
+		common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+	)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := collect(owner, doneBy(editorId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		switch event.InnerEvent.(type) {
+		case common.LockEvent, common.RoleEvent, common.ClearEvent:
+			t.Errorf("%s of the editor broadcast", event.Kind)
+		}
+	}
+	room, err := s.lookup(common.DefaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.Do(func() {
+		if room.locked || room.players[ownerId].Role != common.RoleOwner || len(room.players[editorId].Scribbles) != 1 {
+			t.Errorf("editor moderated the room: locked %v, owner is %s, editor has %d scribbles", room.locked, room.players[ownerId].Role, len(room.players[editorId].Scribbles))
+		}
+	})
+
+	moderation[1].InnerEvent = common.RoleEvent{Id: editorId, Role: common.RoleViewer}
+	if err := send(owner, ownerId, moderation...); err != nil {
+		t.Fatal(err)
+	}
+	events, err = collect(editor, func(event *common.Event) bool {
+		_, clear := event.InnerEvent.(common.ClearEvent)
+		return clear
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var locked, demoted bool
+	for _, event := range events {
+		switch innerEvent := event.InnerEvent.(type) {
+		case common.LockEvent:
+			locked = innerEvent.Locked
+		case common.RoleEvent:
+			demoted = innerEvent.Id == editorId && innerEvent.Role == common.RoleViewer
+		}
+	}
+	if !locked || !demoted {
+		t.Errorf("editor got %v, want the lock, its role and the clear", kinds(events))
+	}
+	room.Do(func() {
+		if !room.locked || room.players[editorId].Role != common.RoleViewer || len(room.players[editorId].Scribbles) != 0 {
+			t.Errorf("owner's moderation not applied: locked %v, editor is %s with %d scribbles", room.locked, room.players[editorId].Role, len(room.players[editorId].Scribbles))
+		}
+	})
+}
+
+func TestUndoWhileDrawingIgnored(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	s, addr := serve(t, config)
+
+	conn, id, err := join(addr, common.PingEvent{Name: "painter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = send(conn, id,
+		common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 1}},
+		common.Event{Kind: "undo", InnerEvent: common.UndoEvent{}},
+		common.Event{Kind: "redo", InnerEvent: common.RedoEvent{}},
+		common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 1, Pixels: []*common.Pixel{pixel(1, 1)}}},
+		common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := collect(conn, doneBy(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		switch event.InnerEvent.(type) {
+		case common.UndoEvent, common.RedoEvent:
+			t.Errorf("%s in the middle of a stroke broadcast", event.Kind)
+		}
+	}
+
+	room, err := s.lookup(common.DefaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.Do(func() {
+		player := room.players[id]
+		if len(player.Scribbles) != 1 || len(player.Scribbles[0]) != 1 || len(player.Deleted) != 0 {
+			t.Errorf("scribbles %v and deleted %v, want the stroke untouched", player.Scribbles, player.Deleted)
+		}
+	})
+}
+
+func TestSpectatorCannotDraw(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	s, addr := serve(t, config)
+
+	painter, painterId, err := join(addr, common.PingEvent{Name: "painter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer painter.Close()
+	stroke := []common.Event{
+		{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 1}},
+		{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 1, Pixels: []*common.Pixel{pixel(1, 1)}}},
+		{Kind: "done", InnerEvent: common.DoneEvent{}},
+	}
+	if err := send(painter, painterId, stroke...); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitFor(painter, doneBy(painterId)); err != nil {
+		t.Fatal(err)
+	}
+
+	spectator, spectatorId, err := join(addr, common.PingEvent{Name: "spectator", Spectator: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spectator.Close()
+	event, err := readEvent(spectator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, ok := event.InnerEvent.(common.SnapshotEvent)
+	if !ok {
+		t.Fatalf("spectator got %s instead of the snapshot", event.Kind)
+	}
+	if len(snapshot.Players) != 1 || len(snapshot.Players[0].Scribbles) != 1 {
+		t.Errorf("snapshot %+v, want the painter's stroke", snapshot)
+	}
+
+	// once the spectator is let go, everything it sent was handled
+	if err := send(spectator, spectatorId, append(stroke, common.Event{Kind: "left", InnerEvent: common.LeftEvent{}})...); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		event, err := readEvent(spectator)
+		if err != nil {
+			break
+		}
+		if event.PlayerId == spectatorId {
+			t.Errorf("%s of the spectator sent back", event.Kind)
+		}
+	}
+	stroke[0].InnerEvent = common.StartedEvent{Stroke: 2}
+	stroke[1].InnerEvent = common.StrokeChunkEvent{Stroke: 2, Pixels: []*common.Pixel{pixel(2, 2)}}
+	if err := send(painter, painterId, stroke...); err != nil {
+		t.Fatal(err)
+	}
+	events, err := collect(painter, doneBy(painterId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if event.PlayerId == spectatorId {
+			t.Errorf("%s of the spectator broadcast", event.Kind)
+		}
+	}
+
+	room, err := s.lookup(common.DefaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.Do(func() {
+		if _, ok := room.players[spectatorId]; ok || len(room.players) != 1 || len(room.players[painterId].Scribbles) != 2 {
+			t.Errorf("%d players, want the painter alone with its 2 scribbles", len(room.players))
+		}
+	})
+}
+
+// resume reconnects with the token, returning the connection and its pong
+func resume(addr string, token string, lastSeq uint64) (net.Conn, *common.Event, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	pong, err := answer(conn, common.PingEvent{Name: "painter", Capabilities: common.CapabilityResume, ResumeToken: token, LastSeq: lastSeq})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, pong, nil
+}
+
+func TestResume(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	config.History = 4
+	s, addr := serve(t, config)
+
+	painter, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer painter.Close()
+	pong, err := answer(painter, common.PingEvent{Name: "painter", Capabilities: common.CapabilityResume})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, ok := pong.InnerEvent.(common.PongEvent)
+	if !ok || session.ResumeToken == "" {
+		t.Fatalf("got %s without a resume token", pong.Kind)
+	}
+	painterId := pong.PlayerId
+	other, otherId, err := join(addr, common.PingEvent{Name: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	stroke := func(conn net.Conn, id int32, n uint32) error {
+		return send(conn, id,
+			common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: n}},
+			common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: n, Pixels: []*common.Pixel{pixel(float32(n), 1)}}},
+			common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+		)
+	}
+	if err := stroke(painter, painterId, 1); err != nil {
+		t.Fatal(err)
+	}
+	events, err := collect(painter, doneBy(painterId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastSeq := events[len(events)-1].Seq
+
+	// the painter's connection is left half-open while the other one draws
+	if err := stroke(other, otherId, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitFor(other, doneBy(otherId)); err != nil {
+		t.Fatal(err)
+	}
+	back, pong, err := resume(addr, session.ResumeToken, lastSeq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer back.Close()
+	if resumed, ok := pong.InnerEvent.(common.PongEvent); !ok || !resumed.Resumed || pong.PlayerId != painterId {
+		t.Fatalf("got %s as player %d, want the session of player %d resumed", pong.Kind, pong.PlayerId, painterId)
+	}
+	missed, err := collect(back, doneBy(otherId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missed) != 3 {
+		t.Errorf("replayed %v, want the other's started, stroke and done", kinds(missed))
+	}
+	for _, event := range missed {
+		if event.Seq <= lastSeq || event.PlayerId != otherId {
+			t.Errorf("replayed %s %d of player %d, want only what came after %d", event.Kind, event.Seq, event.PlayerId, lastSeq)
+		}
+	}
+
+	// the half-open connection was replaced, not kept alongside
+	for {
+		_, err := readEvent(painter)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Error("old connection still open after resuming")
+		}
+		break
+	}
+	room, err := s.lookup(common.DefaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.Do(func() {
+		if len(room.clients) != 2 || room.clients[painterId].Conn == painter {
+			t.Errorf("%d clients, want the painter on its new connection only", len(room.clients))
+		}
+	})
+
+	// more strokes than the history keeps, the painter gets the board instead
+	back.Close()
+	for n := uint32(3); n < 6; n++ {
+		if err := stroke(other, otherId, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := waitFor(other, func(event *common.Event) bool {
+		started, ok := event.InnerEvent.(common.StartedEvent)
+		return ok && started.Stroke == 5
+	}); err != nil {
+		t.Fatal(err)
+	}
+	again, pong, err := resume(addr, session.ResumeToken, lastSeq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if resumed, ok := pong.InnerEvent.(common.PongEvent); !ok || resumed.Resumed || pong.PlayerId != painterId {
+		t.Fatalf("got %s as player %d, want player %d back without a replay", pong.Kind, pong.PlayerId, painterId)
+	}
+	event, err := readEvent(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := event.InnerEvent.(common.SnapshotEvent); !ok {
+		t.Errorf("got %s after the pong, want the snapshot", event.Kind)
+	}
+}
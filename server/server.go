@@ -0,0 +1,520 @@
+// 1. SEND A MAP OF CLIENTS THAT DREW SOMETHING
+// 2. NO CHANNELS NEEDED, JUST A MAP THAT GETS READED AFTER A SERVER TICK
+// 3. ACCUMULATE CHANGES WITHIN TICKS ON A MAP
+//	  AND APPEND TO CLIENT.PIXELS AFTER
+
+// EVENTS RECEIVED BY SERVER
+// - JOINED: Add client to clients map. Send all client's pixels to reconstruct the board.
+// - DRAW: Accumulate pixels on a pixel buffer. Free after each tick
+// - LEFT: Remove client from clients map
+
+// EVENTS SENT BY SERVER
+// DRAW: Sends all accumulated pixels.
+
+// (client) send the pixels from the client,
+// (server) store them in a array of array of pixels [][]Pixel
+// (server) send the pixels from the server back to the client
+// what im thinking:
+// 		the interaction between client and server can be only sending pixel for pixel
+// 		but when other clients interact between each other, the server needs to send the whole array of pixels
+// 		the client then only replace the last array of the other client
+
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"main/common"
+)
+
+type Config struct {
+	Listen     string // host:port, an empty host binds every interface
+	MaxClients int    // 0 means unlimited
+	MaxRooms   int    // 0 means unlimited, a room closes with its last client
+	QueueLimit int    // frames buffered per client before it's evicted as too slow
+	History    int    // broadcast frames kept to replay to resuming clients
+	MaxFrame   int    // largest frame accepted from a client, in bytes
+	Compress   int    // frames above this size are deflated for clients supporting it, 0 disables
+	Log        bool   // enable the server logger
+	LogBytes   bool   // log bytes received every second
+
+	WebSocket        string   // host:port for WebSocket clients, empty disables them
+	WebSocketOrigins []string // hosts besides ours whose pages can open a WebSocket, e.g. "*.example.com"
+	TLSCert          string   // PEM certificate, along with TLSKey enables TLS on both listeners
+	TLSKey           string
+	Password         string   // needed to join, empty leaves the board open unless there are invites
+	Invites          []string // tokens that let a single player in
+
+	DataDir          string        // keeps the boards across restarts, empty keeps them in memory only
+	SnapshotInterval time.Duration // how often a board is saved whole, its log only has what changed since
+
+	HeartbeatInterval time.Duration // 0 disables heartbeats and idle timeouts
+	HeartbeatMisses   int           // heartbeats a peer can miss before it's disconnected
+
+	EventRate float64     // events per second a client can send, 0 is unlimited
+	ByteRate  float64     // bytes per second a client can send, 0 is unlimited
+	Flood     FloodPolicy // what to do with events over the limits
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Listen:     common.DefaultAddress,
+		MaxClients: 0,
+		MaxRooms:   64,
+		QueueLimit: 1024,
+		History:    4096,
+		MaxFrame:   common.DefaultMaxFrameSize,
+		Compress:   common.DefaultCompressThreshold,
+		Log:        false,
+		LogBytes:   false,
+
+		SnapshotInterval: time.Minute,
+
+		HeartbeatInterval: 2 * time.Second,
+		HeartbeatMisses:   3,
+
+		EventRate: 240,
+		ByteRate:  64 << 10,
+		Flood:     FloodCoalesce,
+	}
+}
+
+// IdleTimeout is how long a connection can stay silent
+func (c Config) IdleTimeout() time.Duration {
+	return c.HeartbeatInterval * time.Duration(c.HeartbeatMisses)
+}
+
+var ErrRoomName = errors.New("room name too long")
+var ErrTooManyRooms = errors.New("too many rooms")
+var ErrNoRoom = errors.New("no such room")
+var ErrNoPlayer = errors.New("no such player")
+var ErrRoomStorage = errors.New("room can't be read from disk")
+
+// Server accepts connections and hands them to their room, the
+// board state lives in the rooms, see Room
+type Server struct {
+	Config        Config
+	conns         atomic.Int32
+	bytesReceived atomic.Int64
+	dropped       atomic.Int64 // events over the limits that were discarded
+	coalesced     atomic.Int64 // pixels over the limits replaced by a newer one
+
+	mu      sync.Mutex // guards rooms and invites, used by every room
+	rooms   map[string]*Room
+	invites map[string]bool // invite tokens not used yet
+}
+
+func NewServer(config Config) *Server {
+	s := &Server{
+		Config:  config,
+		rooms:   make(map[string]*Room),
+		invites: make(map[string]bool),
+	}
+	for _, invite := range config.Invites {
+		s.invites[invite] = true
+	}
+	return s
+}
+
+var serverLogger = common.NewLogger(os.Stdout, "[SERVER]: ", log.LstdFlags)
+
+func (s *Server) Start() error {
+	serverLogger.Enabled = s.Config.Log
+
+	var tlsConfig *tls.Config
+	if s.Config.TLSCert != "" || s.Config.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(s.Config.TLSCert, s.Config.TLSKey)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	ln, err := net.Listen("tcp", s.Config.Listen)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	if s.Config.WebSocket != "" {
+		wsLn, err := net.Listen("tcp", s.Config.WebSocket)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		if tlsConfig != nil {
+			wsLn = tls.NewListener(wsLn, tlsConfig)
+		}
+		go func() {
+			if err := s.ServeWebSocket(wsLn); err != nil {
+				serverLogger.Println("WebSocket listener stopped:", err)
+			}
+		}()
+	}
+
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on an already open listener
+func (s *Server) Serve(ln net.Listener) error {
+	if s.Config.LogBytes {
+		go s.Tick()
+	}
+
+	serverLogger.Println("Server running on", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.Accept(conn)
+	}
+}
+
+// Accept reads the connection until it's closed, whatever its transport,
+// unless the server is full
+func (s *Server) Accept(conn net.Conn) {
+	// taking the slot first keeps concurrent accepts from all getting the last one
+	if n := s.conns.Add(1); s.Config.MaxClients > 0 && int(n) > s.Config.MaxClients {
+		s.conns.Add(-1)
+		serverLogger.Println("Rejecting connection, server full:", conn.RemoteAddr())
+		Reject(conn, common.ServerFull, "server is full")
+		return
+	}
+
+	s.ReadConn(conn)
+}
+
+func (s *Server) ReadConn(conn net.Conn) {
+	// the room is known once the handshake is read
+	var room *Room
+	defer s.conns.Add(-1)
+	defer func() {
+		if room != nil {
+			room.closed <- conn
+			s.Release(room)
+		}
+	}()
+	defer conn.Close()
+	defer func(conn net.Conn) {
+		if r := recover(); r != nil {
+			serverLogger.Println("Recovered from panic in ReadConn:", r)
+		}
+	}(conn)
+
+	limiter := NewLimiter(s.Config)
+	dropped, coalesced := 0, 0
+	defer func() {
+		if dropped > 0 || coalesced > 0 {
+			serverLogger.Println("Connection", conn.RemoteAddr(), "went over the limits, dropped", dropped, "coalesced", coalesced)
+		}
+	}()
+
+	// the newest pixel held back by the coalesce policy goes out before the
+	// next event, or after a send tick if the client went quiet meanwhile
+	var pendingMu sync.Mutex // guards pending and limiter against the timer
+	var pending *common.Event
+	stopped := false
+	flush := func() {
+		if pending == nil || stopped {
+			return
+		}
+		// it takes from the buckets like any other event, but being
+		// the last sample of the flood it's never discarded
+		if frame, err := common.EncodeFrame(*pending); err == nil {
+			limiter.Take(len(frame))
+		}
+		room.received <- Received{Event: pending, Conn: conn}
+		pending = nil
+	}
+	flushTimer := time.AfterFunc(time.Hour, func() {
+		pendingMu.Lock()
+		defer pendingMu.Unlock()
+		flush()
+	})
+	flushTimer.Stop()
+	// before the room learns the connection is closed
+	defer func() {
+		pendingMu.Lock()
+		defer pendingMu.Unlock()
+		stopped = true
+		flushTimer.Stop()
+	}()
+
+	// once the handshake started the client's writer owns the connection,
+	// so only the first frame can be answered directly
+	firstFrame := true
+	for {
+		// clients echo every heartbeat, so silence means the peer is gone
+		if s.Config.IdleTimeout() > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.Config.IdleTimeout()))
+		}
+
+		buf, err := common.ReadFrame(conn, s.Config.MaxFrame)
+		if err != nil {
+			serverLogger.Println("Failed to read frame:", err)
+			// panic(err)
+			return
+		}
+		s.bytesReceived.Add(int64(len(buf)))
+
+		event, err := common.Decode(buf)
+		if errors.Is(err, common.ErrUnsupportedVersion) && firstFrame {
+			serverLogger.Println("Rejecting client:", err)
+			Reject(conn, common.VersionMismatch, err.Error())
+			return
+		}
+		if err != nil {
+			serverLogger.Println(event)
+			serverLogger.Println(err)
+			// panic(err)
+			return
+		}
+
+		firstFrame = false
+
+		if room == nil {
+			ping, ok := event.InnerEvent.(common.PingEvent)
+			if !ok {
+				serverLogger.Println("Closing", conn.RemoteAddr(), "which didn't start with a handshake")
+				return
+			}
+			if ping.Version != common.ProtocolVersion {
+				message := fmt.Sprintf("client protocol version %d, server requires %d", ping.Version, common.ProtocolVersion)
+				serverLogger.Println("Rejecting client:", message)
+				Reject(conn, common.VersionMismatch, message)
+				return
+			}
+			// anyone can knock on an open room, opening one takes the password
+			room, err = s.Room(ping.Room, s.Admissible(ping.Password))
+			if errors.Is(err, ErrNoRoom) {
+				serverLogger.Println("Rejecting", conn.RemoteAddr(), "opening room", ping.Room, "with a wrong password")
+				Reject(conn, common.Unauthorized, "wrong password or invite")
+				return
+			}
+			if err != nil {
+				serverLogger.Println("Rejecting", conn.RemoteAddr(), "from room", ping.Room, err)
+				Reject(conn, common.RoomUnavailable, err.Error())
+				return
+			}
+		}
+
+		pendingMu.Lock()
+		if limited(event) && !limiter.Allow(4+len(buf)) {
+			switch s.Config.Flood {
+			case FloodDisconnect:
+				pendingMu.Unlock()
+				serverLogger.Println("Disconnecting", conn.RemoteAddr(), "for flooding")
+				room.flooded <- conn
+				// the writer sends the reason and closes the connection
+				io.Copy(io.Discard, conn)
+				return
+			case FloodCoalesce:
+				if chunk, ok := event.InnerEvent.(common.StrokeChunkEvent); ok && len(chunk.Pixels) > 0 {
+					replaced := len(chunk.Pixels) - 1
+					if pending != nil {
+						replaced++
+					}
+					chunk.Pixels = chunk.Pixels[len(chunk.Pixels)-1:]
+					event.InnerEvent = chunk
+					pending = event
+					flushTimer.Reset(time.Second / 60)
+					pendingMu.Unlock()
+					coalesced += replaced
+					s.coalesced.Add(int64(replaced))
+					continue
+				}
+			}
+			if !boundary(event) {
+				pendingMu.Unlock()
+				dropped++
+				s.dropped.Add(1)
+				continue
+			}
+			// without its start or end the whole stroke would be lost,
+			// or left drawing on every board
+			limiter.Take(4 + len(buf))
+		}
+
+		flush()
+		room.received <- Received{Event: event, Conn: conn}
+		pendingMu.Unlock()
+	}
+}
+
+// Reject tells the peer why it's being refused and closes the connection
+func Reject(conn net.Conn, code common.ErrorCode, message string) {
+	defer conn.Close()
+	err := WriteEvent(conn, common.Event{
+		PlayerId:   -1,
+		Kind:       "error",
+		InnerEvent: common.ErrorEvent{Code: code, Message: message},
+	})
+	if err != nil {
+		serverLogger.Println("Failed to send rejection:", err)
+	}
+}
+
+func WriteEvent(conn net.Conn, event common.Event) error {
+	return common.WriteFrame(conn, event)
+}
+
+// Room takes the room with that name for a connection, opening it
+// on first use when create is set or it was saved, the empty name is
+// common.DefaultRoom. Every room taken has to be given back with Release
+func (s *Server) Room(name string, create bool) (*Room, error) {
+	if name == "" {
+		name = common.DefaultRoom
+	}
+	if len(name) > common.MaxRoomName {
+		return nil, ErrRoomName
+	}
+	var store *Store
+	if s.Config.DataDir != "" {
+		store = NewStore(s.Config.DataDir, name)
+		create = create || store.Saved()
+	}
+
+	for {
+		s.mu.Lock()
+		room, ok := s.rooms[name]
+		if ok && room.closing {
+			// its last snapshot has to be written before it's read again
+			s.mu.Unlock()
+			<-room.stopped
+			continue
+		}
+		if ok {
+			room.conns++
+			s.mu.Unlock()
+			<-room.ready
+			if room.err != nil {
+				return nil, room.err
+			}
+			return room, nil
+		}
+		if !create {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("%w: %s", ErrNoRoom, name)
+		}
+		if s.Config.MaxRooms > 0 && len(s.rooms) >= s.Config.MaxRooms {
+			s.mu.Unlock()
+			return nil, ErrTooManyRooms
+		}
+
+		// the name is taken right away, whoever joins meanwhile waits for ready
+		serverLogger.Println("Opening room", name)
+		room = NewRoom(s, name)
+		room.conns = 1
+		s.rooms[name] = room
+		s.mu.Unlock()
+
+		if store != nil {
+			if err := room.Restore(store); err != nil {
+				serverLogger.Println("Failed to restore room", name, err)
+				s.mu.Lock()
+				delete(s.rooms, name)
+				s.mu.Unlock()
+				room.err = ErrRoomStorage
+				close(room.ready)
+				return nil, room.err
+			}
+		}
+		close(room.ready)
+		go room.Run()
+		return room, nil
+	}
+}
+
+// Release gives back a room taken by Room, the last connection
+// closes it, see Room.Close
+func (s *Server) Release(room *Room) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room.conns--
+	if room.conns > 0 {
+		return
+	}
+	serverLogger.Println("Closing room", room.Name)
+	room.closing = true
+	close(room.done)
+}
+
+// Admit tells whether the password lets a new player in,
+// an invite is used up once it did
+func (s *Server) Admit(password string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.passes(password) {
+		return true
+	}
+	if s.invites[password] {
+		delete(s.invites, password)
+		return true
+	}
+	return false
+}
+
+// Admissible tells whether Admit would let the password in,
+// without using up the invite
+func (s *Server) Admissible(password string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.passes(password) || s.invites[password]
+}
+
+// passes tells whether the board is open or the password is right,
+// s.mu has to be held
+func (s *Server) passes(password string) bool {
+	if s.Config.Password == "" && len(s.Config.Invites) == 0 {
+		return true
+	}
+	return s.Config.Password != "" && subtle.ConstantTimeCompare([]byte(password), []byte(s.Config.Password)) == 1
+}
+
+func (s *Server) Tick() {
+	ticker := time.NewTicker(time.Second / 60)
+
+	counter := 0
+
+	for {
+		<-ticker.C
+		if counter%60 == 0 {
+			serverLogger.Println("MB: ", prettySIByteSize(int(s.bytesReceived.Load())))
+			serverLogger.Println("Over the limits: dropped", s.dropped.Load(), "coalesced", s.coalesced.Load())
+		}
+		counter++
+	}
+}
+
+func prettySIByteSize(b int) string {
+	bf := float64(b)
+	for _, unit := range []string{"", "k", "M", "G", "T", "P", "E", "Z"} {
+		if bf < 1000.0 {
+			return fmt.Sprintf("%.1f %sB", bf, unit)
+		}
+		bf /= 1000.0
+	}
+	return fmt.Sprintf("%.1f YB", bf)
+}
+
+func StartServer(config Config) error {
+	server := NewServer(config)
+	return server.Start()
+}
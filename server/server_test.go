@@ -0,0 +1,274 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"main/common"
+)
+
+// serve runs a server on a free local port until the test ends
+func serve(t *testing.T, config Config) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(config)
+	go s.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return s, ln.Addr().String()
+}
+
+// join connects to addr and returns the connection along with
+// the player id handed out in the pong
+func join(addr string, ping common.PingEvent) (net.Conn, int32, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	id, err := handshake(conn, ping)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	return conn, id, nil
+}
+
+// handshake sends the ping and waits for the pong, whatever the transport
+func handshake(conn net.Conn, ping common.PingEvent) (int32, error) {
+	event, err := answer(conn, ping)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := event.InnerEvent.(common.PongEvent); !ok {
+		return 0, fmt.Errorf("got %s instead of a pong", event.Kind)
+	}
+	return event.PlayerId, nil
+}
+
+// answer sends the ping and returns the first event the server sends back
+func answer(conn net.Conn, ping common.PingEvent) (*common.Event, error) {
+	ping.Version = common.ProtocolVersion
+	if err := common.WriteFrame(conn, common.Event{Kind: "ping", InnerEvent: ping}); err != nil {
+		return nil, err
+	}
+	return readEvent(conn)
+}
+
+func readEvent(conn net.Conn) (*common.Event, error) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame, err := common.ReadFrame(conn, common.DefaultMaxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	return common.Decode(frame)
+}
+
+// waitFor reads the broadcasts until one matches
+func waitFor(conn net.Conn, match func(*common.Event) bool) error {
+	for {
+		event, err := readEvent(conn)
+		if err != nil {
+			return err
+		}
+		if match(event) {
+			return nil
+		}
+	}
+}
+
+// send writes the events of a player in order
+func send(conn net.Conn, id int32, events ...common.Event) error {
+	for _, event := range events {
+		event.PlayerId = id
+		if err := common.WriteFrame(conn, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestServeConcurrentClients(t *testing.T) {
+	const clients = 16
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	s, addr := serve(t, config)
+
+	conns := make([]net.Conn, clients)
+	ids := make([]int32, clients)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, id, err := join(addr, common.PingEvent{Name: fmt.Sprint("painter ", i)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conns[i], ids[i] = conn, id
+			err = send(conn, id,
+				common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 1}},
+				common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 1, Pixels: []*common.Pixel{pixel(1, 1), pixel(2, 2)}}},
+				common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+				common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 2}},
+				common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 2, Pixels: []*common.Pixel{pixel(3, 3)}}},
+				common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+				common.Event{Kind: "undo", InnerEvent: common.UndoEvent{}},
+			)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			// everything sent is broadcast back in order, the undo comes last
+			err = waitFor(conn, func(event *common.Event) bool {
+				_, undo := event.InnerEvent.(common.UndoEvent)
+				return undo && event.PlayerId == id
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	t.Cleanup(func() {
+		for _, conn := range conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	})
+	if t.Failed() {
+		return
+	}
+
+	room, err := s.lookup(common.DefaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.Do(func() {
+		if len(room.players) != clients {
+			t.Errorf("%d players, want %d", len(room.players), clients)
+		}
+		for _, player := range room.players {
+			if len(player.Scribbles) != 1 || len(player.Scribbles[0]) != 2 || len(player.Deleted) != 1 {
+				t.Errorf("player %d has %d scribbles and %d deleted, want 1 of 2 pixels and 1", player.Id, len(player.Scribbles), len(player.Deleted))
+			}
+		}
+	})
+
+	for i, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := send(conn, ids[i], common.Event{Kind: "left", InnerEvent: common.LeftEvent{}}); err != nil {
+				t.Error(err)
+			}
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+
+	// the room isn't saved, so it closes with its last client
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := s.lookup(common.DefaultRoom)
+		if err != nil && s.conns.Load() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("room still open or %d connections counted after every client left", s.conns.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// refused sends the ping and returns the code of the error it gets instead of a pong
+func refused(addr string, ping common.PingEvent) (common.ErrorCode, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	event, err := answer(conn, ping)
+	if err != nil {
+		return 0, err
+	}
+	refusal, ok := event.InnerEvent.(common.ErrorEvent)
+	if !ok {
+		return 0, fmt.Errorf("got %s instead of an error", event.Kind)
+	}
+	return refusal.Code, nil
+}
+
+func TestAdmit(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	config.Password = "secret"
+	config.Invites = []string{"invite"}
+	_, addr := serve(t, config)
+
+	// neither opening a room nor joining one works without the password
+	code, err := refused(addr, common.PingEvent{Name: "stranger", Password: "guess"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != common.Unauthorized {
+		t.Errorf("opening a room refused with code %d, want %d", code, common.Unauthorized)
+	}
+
+	owner, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	pong, err := answer(owner, common.PingEvent{Name: "owner", Password: "secret", Capabilities: common.CapabilityResume})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, ok := pong.InnerEvent.(common.PongEvent)
+	if !ok || session.ResumeToken == "" {
+		t.Fatalf("got %s without a resume token", pong.Kind)
+	}
+	ownerId := pong.PlayerId
+
+	code, err = refused(addr, common.PingEvent{Name: "stranger", Password: "guess"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != common.Unauthorized {
+		t.Errorf("joining refused with code %d, want %d", code, common.Unauthorized)
+	}
+
+	guest, _, err := join(addr, common.PingEvent{Name: "guest", Password: "invite"})
+	if err != nil {
+		t.Fatalf("invite refused: %v", err)
+	}
+	defer guest.Close()
+	code, err = refused(addr, common.PingEvent{Name: "guest's friend", Password: "invite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != common.Unauthorized {
+		t.Errorf("used invite refused with code %d, want %d", code, common.Unauthorized)
+	}
+
+	// the token is proof enough, no password needed to come back
+	owner.Close()
+	back, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer back.Close()
+	pong, err = answer(back, common.PingEvent{Name: "owner", Capabilities: common.CapabilityResume, ResumeToken: session.ResumeToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed, ok := pong.InnerEvent.(common.PongEvent); !ok || !resumed.Resumed || pong.PlayerId != ownerId {
+		t.Errorf("got %s as player %d, want the session of player %d resumed", pong.Kind, pong.PlayerId, ownerId)
+	}
+}
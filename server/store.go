@@ -0,0 +1,425 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"main/common"
+)
+
+// A room on disk is a snapshot of its board, rewritten every SnapshotInterval,
+// and a write-ahead log of everything that changed since. Every log record is
+//
+//	length  uint32
+//	crc32   uint32 of the payload
+//	payload: kind uint8 followed by the record
+//
+// and the log starts with the generation of the snapshot it follows, a log
+// left behind by a crash while a new snapshot was being written is stale and
+// skipped. A record cut short by a crash ends the log.
+
+const (
+	// a broadcast event in the wire encoding, see common.Encode
+	recordEvent uint8 = iota + 1
+	// a new player as JSON, the wire doesn't carry its token and address
+	recordPlayer
+	// a token or address kept out, see Room.Ban
+	recordBannedToken
+	recordBannedAddress
+	// an address or token let back in, see Room.Unban
+	recordUnban
+)
+
+const walHeaderSize = 8
+
+// largest record read back, the same bound clients use for server frames
+const maxRecordSize = 256 << 20
+
+var ErrCorruptRecord = errors.New("corrupt log record")
+
+// boardState is what the snapshot keeps of a room
+type boardState struct {
+	Generation      uint64
+	Seq             uint64
+	LastId          int32
+	Locked          bool
+	Players         []*Player
+	BannedTokens    []string
+	BannedAddresses []string
+}
+
+type Store struct {
+	path       string // of the files without their extension
+	generation uint64 // of the snapshot on disk, the log must match it
+	wal        *os.File
+}
+
+func NewStore(dir string, room string) *Store {
+	return &Store{path: filepath.Join(dir, fileName(room))}
+}
+
+// fileName keeps letters, digits, dashes and underscores of the room name
+// and escapes the rest, so any name is a valid file name
+func fileName(room string) string {
+	var name strings.Builder
+	for _, c := range []byte(room) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+			name.WriteByte(c)
+		default:
+			fmt.Fprintf(&name, "%%%02X", c)
+		}
+	}
+	return name.String()
+}
+
+// Saved tells whether the room was ever written to the store
+func (st *Store) Saved() bool {
+	_, err := os.Stat(st.path + ".snapshot")
+	return err == nil
+}
+
+// Load reads the snapshot and the payloads of the log records written after it,
+// the state is nil when the room was never saved. A record cut short or
+// damaged by a crash ends the log, along with everything after it.
+func (st *Store) Load() (*boardState, [][]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(st.path), 0755); err != nil {
+		return nil, nil, err
+	}
+
+	var state *boardState
+	snapshot, err := os.Open(st.path + ".snapshot")
+	if err == nil {
+		defer snapshot.Close()
+		state = &boardState{}
+		if err := gob.NewDecoder(bufio.NewReader(snapshot)).Decode(state); err != nil {
+			return nil, nil, fmt.Errorf("reading %s: %w", snapshot.Name(), err)
+		}
+		st.generation = state.Generation
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	wal, err := os.Open(st.path + ".wal")
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wal.Close()
+
+	r := bufio.NewReader(wal)
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || binary.BigEndian.Uint64(header[:]) != st.generation {
+		serverLogger.Println("Skipping stale log", wal.Name())
+		return state, nil, nil
+	}
+
+	var records [][]byte
+	for {
+		payload, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			serverLogger.Println("Log", wal.Name(), "ends with a broken record after", len(records), "records:", err)
+			break
+		}
+		records = append(records, payload)
+	}
+	return state, records, nil
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length == 0 || length > maxRecordSize {
+		return nil, fmt.Errorf("%w: length %d", ErrCorruptRecord, length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptRecord)
+	}
+	return payload, nil
+}
+
+// Snapshot replaces the snapshot with state and starts a new, empty log,
+// the old snapshot stays in place until the new one is complete
+func (st *Store) Snapshot(state *boardState) error {
+	state.Generation = st.generation + 1
+
+	tmp, err := os.Create(st.path + ".snapshot.tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = gob.NewEncoder(w).Encode(state)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), st.path+".snapshot")
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	st.generation = state.Generation
+
+	// from here on the old log is stale, even if a crash leaves it around
+	if st.wal != nil {
+		st.wal.Close()
+	}
+	st.wal, err = os.Create(st.path + ".wal")
+	if err != nil {
+		return err
+	}
+	var header [walHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:], st.generation)
+	if _, err := st.wal.Write(header[:]); err != nil {
+		return err
+	}
+	return st.wal.Sync()
+}
+
+// Append writes a record to the log, it reaches the disk whenever the
+// system flushes it, a crash of the server alone loses nothing
+func (st *Store) Append(kind uint8, record []byte) error {
+	if st.wal == nil {
+		return errors.New("no log open, take a snapshot first")
+	}
+	buf := make([]byte, 8, 9+len(record))
+	buf = append(buf, kind)
+	buf = append(buf, record...)
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(buf)-8))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(buf[8:]))
+	_, err := st.wal.Write(buf)
+	return err
+}
+
+func (st *Store) Close() error {
+	if st.wal == nil {
+		return nil
+	}
+	return st.wal.Close()
+}
+
+// Restore rebuilds the room from what the store has on disk and keeps it
+// up to date from then on, the log is compacted into a new snapshot
+func (r *Room) Restore(store *Store) error {
+	state, records, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	if state != nil {
+		r.seq = state.Seq
+		r.lastId = state.LastId
+		r.locked = state.Locked
+		// before the players, banned tokens don't get their session back
+		for _, token := range state.BannedTokens {
+			r.bannedTokens[token] = true
+		}
+		for _, address := range state.BannedAddresses {
+			r.bannedAddresses[address] = true
+		}
+		for _, player := range state.Players {
+			r.AddPlayer(player)
+		}
+	}
+	for _, record := range records {
+		if err := r.Replay(record); err != nil {
+			serverLogger.Println("Room", r.Name, "skipping a log record:", err)
+		}
+	}
+	// nobody is connected, so nobody is drawing
+	for _, player := range r.players {
+		player.Drawing = false
+	}
+
+	if err := store.Snapshot(r.snapshotState()); err != nil {
+		return err
+	}
+	r.store = store
+	if state != nil || len(records) > 0 {
+		serverLogger.Println("Restored room", r.Name, "with", len(r.players), "players from a snapshot and", len(records), "log records")
+	}
+	return nil
+}
+
+// AddPlayer puts back a player that was saved, it can resume its session
+func (r *Room) AddPlayer(player *Player) {
+	r.players[player.Id] = player
+	if player.Id > r.lastId {
+		r.lastId = player.Id
+	}
+	if player.Token != "" && !r.bannedTokens[player.Token] {
+		r.sessions[player.Token] = player.Id
+	}
+}
+
+// Replay applies a log record the way the room applied it when it was written,
+// the events were already checked then
+func (r *Room) Replay(record []byte) error {
+	switch record[0] {
+	case recordPlayer:
+		player := NewPlayer(0, "", 0)
+		if err := json.Unmarshal(record[1:], player); err != nil {
+			return err
+		}
+		r.AddPlayer(player)
+		return nil
+	case recordBannedToken:
+		r.bannedTokens[string(record[1:])] = true
+		delete(r.sessions, string(record[1:]))
+		return nil
+	case recordBannedAddress:
+		r.bannedAddresses[string(record[1:])] = true
+		return nil
+	case recordUnban:
+		r.Unban(string(record[1:]))
+		return nil
+	case recordEvent:
+	default:
+		return fmt.Errorf("%w: kind %d", ErrCorruptRecord, record[0])
+	}
+
+	event, err := common.Decode(record[1:])
+	if err != nil {
+		return err
+	}
+	if event.Seq > r.seq {
+		r.seq = event.Seq
+	}
+	switch innerEvent := event.InnerEvent.(type) {
+	case common.ClearEvent:
+		for _, player := range r.players {
+			player.Scribbles = make([][]*common.Pixel, 0)
+			player.Deleted = make([][]*common.Pixel, 0)
+		}
+		return nil
+	case common.LockEvent:
+		r.locked = innerEvent.Locked
+		return nil
+	case common.RoleEvent:
+		if target, ok := r.players[innerEvent.Id]; ok {
+			target.Role = innerEvent.Role
+		}
+		return nil
+	}
+
+	player, ok := r.players[event.PlayerId]
+	if !ok {
+		return fmt.Errorf("%w: %s of unknown player %d", ErrCorruptRecord, event.Kind, event.PlayerId)
+	}
+	switch innerEvent := event.InnerEvent.(type) {
+	case common.StartedEvent:
+		player.Drawing = true
+		player.Stroke = innerEvent.Stroke
+		common.Append(&player.Scribbles, []*common.Pixel{})
+	case common.DoneEvent:
+		player.Drawing = false
+	case common.StrokeChunkEvent:
+		maxIndex := len(player.Scribbles) - 1
+		if maxIndex >= 0 {
+			player.Scribbles[maxIndex] = append(player.Scribbles[maxIndex], innerEvent.Pixels...)
+		}
+	case common.UndoEvent:
+		maxIndex := len(player.Scribbles) - 1
+		if maxIndex >= 0 {
+			common.Append(&player.Deleted, player.Scribbles[maxIndex])
+			player.Scribbles = player.Scribbles[:maxIndex]
+		}
+	case common.RedoEvent:
+		maxIndex := len(player.Deleted) - 1
+		if maxIndex >= 0 {
+			common.Append(&player.Scribbles, player.Deleted[maxIndex])
+			player.Deleted = player.Deleted[:maxIndex]
+		}
+	case common.PurgeEvent:
+		player.Scribbles = make([][]*common.Pixel, 0)
+		player.Deleted = make([][]*common.Pixel, 0)
+	}
+	return nil
+}
+
+// LogPlayer appends a new player to the log of the room, if it's saved
+func (r *Room) LogPlayer(player *Player) {
+	if r.store == nil {
+		return
+	}
+	record, err := json.Marshal(player)
+	if err != nil {
+		serverLogger.Println("Failed to encode player for the log:", err)
+		return
+	}
+	r.Append(recordPlayer, record)
+}
+
+// Append writes a record to the log of the room, if it's saved
+func (r *Room) Append(kind uint8, record []byte) {
+	if r.store == nil {
+		return
+	}
+	if err := r.store.Append(kind, record); err != nil {
+		serverLogger.Println("Failed to append to the log of room", r.Name, err)
+	}
+}
+
+// SaveSnapshot writes the whole board of the room, if it's saved,
+// which empties its log
+func (r *Room) SaveSnapshot() {
+	if r.store == nil {
+		return
+	}
+	if err := r.store.Snapshot(r.snapshotState()); err != nil {
+		serverLogger.Println("Failed to save room", r.Name, err)
+	}
+}
+
+// snapshotState is what a snapshot keeps of the room
+func (r *Room) snapshotState() *boardState {
+	state := &boardState{
+		Seq:     r.seq,
+		LastId:  r.lastId,
+		Locked:  r.locked,
+		Players: make([]*Player, 0, len(r.players)),
+	}
+	for id := int32(0); id <= r.lastId; id++ {
+		if player, ok := r.players[id]; ok {
+			common.Append(&state.Players, player)
+		}
+	}
+	for token := range r.bannedTokens {
+		common.Append(&state.BannedTokens, token)
+	}
+	for address := range r.bannedAddresses {
+		common.Append(&state.BannedAddresses, address)
+	}
+	return state
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"errors"
+	"image/color"
+	"os"
+	"reflect"
+	"testing"
+
+	"main/common"
+)
+
+func pixel(x, y float32) *common.Pixel {
+	return &common.Pixel{
+		Center: common.Vector2{X: x, Y: y},
+		Radius: 4,
+		Color:  color.RGBA{R: 255, A: 255},
+	}
+}
+
+// logEvents appends events to the log of the room the way SendEvent does
+func logEvents(t *testing.T, room *Room, events ...common.Event) {
+	t.Helper()
+	for _, event := range events {
+		room.seq++
+		event.Seq = room.seq
+		encoded, err := common.Encode(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		room.Append(recordEvent, encoded.Bytes())
+	}
+}
+
+func TestRestoreTornLog(t *testing.T) {
+	config := DefaultConfig()
+	config.DataDir = t.TempDir()
+	const name = "my room/.."
+
+	room := NewRoom(NewServer(config), name)
+	if err := room.Restore(NewStore(config.DataDir, name)); err != nil {
+		t.Fatal(err)
+	}
+	player := NewPlayer(0, "owner", common.RoleOwner)
+	room.players[0] = player
+	room.lastId = 0
+	room.LogPlayer(player)
+	logEvents(t, room,
+		common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 1}},
+		common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 1, Pixels: []*common.Pixel{pixel(1, 1), pixel(2, 2)}}},
+		common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+		common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 2}},
+		common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 2, Pixels: []*common.Pixel{pixel(3, 3)}}},
+		common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+		common.Event{Kind: "undo", InnerEvent: common.UndoEvent{}},
+		common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 3}},
+		common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 3, Pixels: []*common.Pixel{pixel(4, 4)}}},
+	)
+	wal := room.store.path + ".wal"
+	before, err := os.Stat(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logEvents(t, room, common.Event{Kind: "stroke", InnerEvent: common.StrokeChunkEvent{Stroke: 3, Pixels: []*common.Pixel{pixel(5, 5), pixel(6, 6)}}})
+	room.store.Close()
+
+	// the server died in the middle of writing the last record
+	after, err := os.Stat(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(wal, before.Size()+(after.Size()-before.Size())/2); err != nil {
+		t.Fatal(err)
+	}
+
+	// a room on disk opens even for clients that couldn't create one
+	s := NewServer(config)
+	restored, err := s.Room(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		s.Release(restored)
+		<-restored.stopped
+	}()
+
+	restored.Do(func() {
+		got := restored.players[0]
+		if got == nil {
+			t.Fatal("player not restored")
+		}
+		wantScribbles := [][]*common.Pixel{{pixel(1, 1), pixel(2, 2)}, {pixel(4, 4)}}
+		if !reflect.DeepEqual(got.Scribbles, wantScribbles) {
+			t.Errorf("scribbles %v, want %v", got.Scribbles, wantScribbles)
+		}
+		wantDeleted := [][]*common.Pixel{{pixel(3, 3)}}
+		if !reflect.DeepEqual(got.Deleted, wantDeleted) {
+			t.Errorf("deleted %v, want %v", got.Deleted, wantDeleted)
+		}
+		if got.Drawing {
+			t.Error("player still drawing after a restart")
+		}
+		if restored.seq != room.seq-1 {
+			t.Errorf("seq %d, want %d", restored.seq, room.seq-1)
+		}
+	})
+}
+
+func TestLoadSkipsStaleLog(t *testing.T) {
+	dir := t.TempDir()
+	store := NewStore(dir, "stale")
+	if _, _, err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Snapshot(&boardState{LastId: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(recordBannedAddress, []byte("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.ReadFile(store.path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash right after the new snapshot was renamed in place
+	// leaves the log of the previous generation behind
+	if err := store.Snapshot(&boardState{LastId: -1, Locked: true}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	if err := os.WriteFile(store.path+".wal", old, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, records, err := NewStore(dir, "stale").Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil || state.Generation != 2 || !state.Locked {
+		t.Fatalf("state %+v, want the second snapshot", state)
+	}
+	if len(records) != 0 {
+		t.Errorf("%d records read from a stale log", len(records))
+	}
+}
+
+func TestIdleSavedRoomsClose(t *testing.T) {
+	config := DefaultConfig()
+	config.DataDir = t.TempDir()
+	config.MaxRooms = 1
+	s := NewServer(config)
+
+	first, err := s.Room("first", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Do(func() {
+		// only the snapshot written on close keeps this drawing
+		player := NewPlayer(0, "owner", common.RoleOwner)
+		player.Scribbles = [][]*common.Pixel{{pixel(1, 1)}}
+		first.players[0] = player
+		first.lastId = 0
+	})
+	s.Release(first)
+	<-first.stopped
+
+	// the first room gave its slot back when it closed
+	second, err := s.Room("second", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Room("third", true); !errors.Is(err, ErrTooManyRooms) {
+		t.Errorf("got %v with a room open, want %v", err, ErrTooManyRooms)
+	}
+	s.Release(second)
+	<-second.stopped
+
+	again, err := s.Room("first", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		s.Release(again)
+		<-again.stopped
+	}()
+	if again == first {
+		t.Fatal("closed room handed out again")
+	}
+	again.Do(func() {
+		if player := again.players[0]; player == nil || len(player.Scribbles) != 1 {
+			t.Errorf("first room reopened without its drawing")
+		}
+	})
+}
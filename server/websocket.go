@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/coder/websocket"
+)
+
+// ServeWebSocket accepts WebSocket connections on an already open listener,
+// they carry the same frames as TCP, in binary messages
+func (s *Server) ServeWebSocket(ln net.Listener) error {
+	serverLogger.Println("WebSocket server running on", ln.Addr())
+	return http.Serve(ln, s.WebSocketHandler())
+}
+
+// WebSocketHandler upgrades every request, so it can be mounted
+// on any path of an existing http server
+func (s *Server) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			OriginPatterns: s.Config.WebSocketOrigins,
+		})
+		if err != nil {
+			serverLogger.Println("Failed to accept WebSocket:", err)
+			return
+		}
+		// the connection is hijacked, it lives on after the request
+		s.Accept(websocket.NetConn(context.Background(), c, websocket.MessageBinary))
+	})
+}
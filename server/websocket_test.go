@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"main/common"
+)
+
+func TestWebSocket(t *testing.T) {
+	config := DefaultConfig()
+	config.HeartbeatInterval = 0
+	s := NewServer(config)
+	ts := httptest.NewServer(s.WebSocketHandler())
+	defer ts.Close()
+
+	conn, err := common.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	id, err := handshake(conn, common.PingEvent{Name: "browser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// frames keep flowing both ways after the handshake
+	err = send(conn, id,
+		common.Event{Kind: "started", InnerEvent: common.StartedEvent{Stroke: 1}},
+		common.Event{Kind: "done", InnerEvent: common.DoneEvent{}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitFor(conn, doneBy(id)); err != nil {
+		t.Fatal(err)
+	}
+}
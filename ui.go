@@ -2,6 +2,7 @@ package main
 
 import (
 	"math"
+	"strings"
 
 	rl "github.com/gen2brain/raylib-go/raylib"
 )
@@ -53,6 +54,76 @@ func NewButton(x int, y int, width int, height int, backgroundColor rl.Color, te
 
 }
 
+type TextInput struct {
+	Rectangle rl.Rectangle
+	Text      string
+	Label     string
+	FontSize  int32
+	Focused   bool
+	MaxLength int
+	Masked    bool // draws the text as stars, for passwords
+}
+
+func NewTextInput(x int, y int, width int, height int, text string, fontSize int32) TextInput {
+	return TextInput{Rectangle: rl.Rectangle{
+		X:      float32(x) - (float32(width) / 2),
+		Y:      float32(y) - (float32(height) / 2),
+		Width:  float32(width),
+		Height: float32(height),
+	},
+		Text:      text,
+		Label:     "Address",
+		FontSize:  fontSize,
+		Focused:   false,
+		MaxLength: 64,
+	}
+}
+
+func (t *TextInput) IsHovering() bool {
+	return rl.CheckCollisionPointRec(rl.GetMousePosition(), t.Rectangle)
+}
+
+// Update focuses the input on click and, while focused, consumes typed characters
+func (t *TextInput) Update() {
+	if rl.IsMouseButtonReleased(rl.MouseButtonLeft) {
+		t.Focused = t.IsHovering()
+	}
+
+	if !t.Focused {
+		return
+	}
+
+	for char := rl.GetCharPressed(); char > 0; char = rl.GetCharPressed() {
+		if char >= 32 && char <= 126 && len(t.Text) < t.MaxLength {
+			t.Text += string(rune(char))
+		}
+	}
+
+	if rl.IsKeyPressed(rl.KeyBackspace) && len(t.Text) > 0 {
+		t.Text = t.Text[:len(t.Text)-1]
+	}
+}
+
+func (t *TextInput) Draw() {
+	rec := t.Rectangle.ToInt32()
+	borderColor := rl.Gray
+	if t.Focused {
+		borderColor = rl.Black
+	}
+	rl.DrawText(t.Label, rec.X, rec.Y-24, 20, rl.Gray)
+	rl.DrawRectangleLinesEx(t.Rectangle, 3, borderColor)
+
+	text := t.Text
+	if t.Masked {
+		text = strings.Repeat("*", len(t.Text))
+	}
+	if t.Focused {
+		text += "_"
+	}
+	textRec := rl.MeasureTextEx(rl.GetFontDefault(), text, float32(t.FontSize), 0)
+	rl.DrawText(text, rec.X+10, rec.Y+(rec.Height/2)-int32(textRec.Y)/2, t.FontSize, rl.Black)
+}
+
 type ColorPicker struct {
 	Colors                       []rl.Color
 	Center                       rl.Vector2